@@ -0,0 +1,388 @@
+package blog
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/luci/gae/service/datastore"
+	"golang.org/x/net/context"
+)
+
+// The Atom Publishing Protocol (RFC 5023) lets editors and scripts manage
+// posts. The service document lists a single collection of posts, whose
+// members are the posts as Atom entries with their markdown source as text
+// content.
+
+const (
+	atomEntryMediaType     = "application/atom+xml;type=entry"
+	atomEntryContentType   = atomEntryMediaType + ";charset=utf-8"
+	atomFeedContentType    = "application/atom+xml;type=feed;charset=utf-8"
+	atomServiceContentType = "application/atomsvc+xml;charset=utf-8"
+	maxAtomPubEntrySize    = 1 << 20
+	atomPubCollectionTitle = "Posts"
+)
+
+type atomPubService struct {
+	XMLName   xml.Name         `xml:"http://www.w3.org/2007/app service"`
+	Workspace atomPubWorkspace `xml:"workspace"`
+}
+
+type atomPubWorkspace struct {
+	Title      string               `xml:"http://www.w3.org/2005/Atom title"`
+	Collection atomPubCollectionDoc `xml:"collection"`
+}
+
+type atomPubCollectionDoc struct {
+	Href       string            `xml:"href,attr"`
+	Title      string            `xml:"http://www.w3.org/2005/Atom title"`
+	Accept     string            `xml:"accept"`
+	Categories atomPubCategories `xml:"categories"`
+}
+
+type atomPubCategories struct {
+	Fixed string `xml:"fixed,attr"`
+}
+
+type atomPubFeed struct {
+	XMLName xml.Name       `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string         `xml:"id"`
+	Title   string         `xml:"title"`
+	Updated time.Time      `xml:"updated"`
+	Links   []atomPubLink  `xml:"link"`
+	Entries []atomPubEntry `xml:"entry"`
+}
+
+// atomPubEntry is a post as an Atom entry, as sent to and received from
+// clients.
+type atomPubEntry struct {
+	XMLName    xml.Name          `xml:"http://www.w3.org/2005/Atom entry"`
+	ID         string            `xml:"id"`
+	Title      atomPubText       `xml:"title"`
+	Updated    time.Time         `xml:"updated"`
+	Published  time.Time         `xml:"published"`
+	Edited     time.Time         `xml:"http://www.w3.org/2007/app edited"`
+	Author     *atomPubPerson    `xml:"author"`
+	Links      []atomPubLink     `xml:"link"`
+	Categories []atomPubCategory `xml:"category"`
+	Summary    *atomPubText      `xml:"summary"`
+	Content    *atomPubText      `xml:"content"`
+	Control    *atomPubControl   `xml:"http://www.w3.org/2007/app control"`
+}
+
+// atomPubText is an Atom text construct. Text and HTML arrive as character
+// data, XHTML as a div of elements, whose content is kept as it is.
+type atomPubText struct {
+	Type  string `xml:"type,attr,omitempty"`
+	Body  string `xml:",chardata"`
+	Inner string `xml:",innerxml"`
+}
+
+const xhtmlNamespace = "http://www.w3.org/1999/xhtml"
+
+func (t *atomPubText) text() string {
+	if t == nil {
+		return ""
+	}
+	if t.Type == "xhtml" {
+		return strings.TrimSpace(unwrapXHTMLDiv(t.Inner))
+	}
+	return strings.TrimSpace(t.Body)
+}
+
+// unwrapXHTMLDiv returns the content of the XHTML div that wraps XHTML text
+// constructs (RFC 4287, section 3.1.1.3). Anything else is returned as it is.
+func unwrapXHTMLDiv(inner string) string {
+	d := xml.NewDecoder(strings.NewReader(inner))
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return inner
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			if token.Name.Space != xhtmlNamespace || token.Name.Local != "div" {
+				return inner
+			}
+			start := d.InputOffset()
+			if err := d.Skip(); err != nil {
+				return inner
+			}
+			end := strings.LastIndex(inner[:d.InputOffset()], "</")
+			if end < int(start) {
+				return inner
+			}
+			return inner[start:end]
+		case xml.CharData:
+			if strings.TrimSpace(string(token)) != "" {
+				return inner
+			}
+		}
+	}
+}
+
+type atomPubPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomPubLink struct {
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomPubCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomPubControl struct {
+	Draft string `xml:"http://www.w3.org/2007/app draft"`
+}
+
+// newAtomPubEntry returns the entry for a post. site is the scheme and host the
+// blog is served from.
+func newAtomPubEntry(p *Post, config *Config, site string) atomPubEntry {
+	entry := atomPubEntry{
+		ID:        config.tagURI("post/" + p.Slug.StringID()),
+		Title:     atomPubText{Type: "text", Body: p.Title},
+		Updated:   p.Updated,
+		Published: p.Created,
+		Edited:    p.Updated,
+		Author:    &atomPubPerson{Name: config.feedAuthor()},
+		Links: []atomPubLink{
+			{Rel: "edit", Href: site + atomPubMemberPath(p)},
+			{Rel: "alternate", Type: "text/html", Href: site + string(p.Url())},
+		},
+		Content: &atomPubText{Type: "text", Body: p.Text},
+	}
+	if p.Excerpt != "" {
+		entry.Summary = &atomPubText{Type: "text", Body: p.Excerpt}
+	}
+	for _, tag := range p.Tags {
+		entry.Categories = append(entry.Categories, atomPubCategory{Term: tag})
+	}
+	if p.Draft {
+		entry.Control = &atomPubControl{Draft: "yes"}
+	}
+	return entry
+}
+
+// apply updates the post from the entry. Entries that are not drafts publish
+// the post right away, even if it was scheduled.
+func (entry *atomPubEntry) apply(p *Post) error {
+	title := entry.Title.text()
+	if title == "" {
+		return fmt.Errorf("entry has no title")
+	}
+	p.Title = title
+	p.Text = entry.Content.text()
+	p.Excerpt = entry.Summary.text()
+	terms := make([]string, len(entry.Categories))
+	for i, category := range entry.Categories {
+		terms[i] = category.Term
+	}
+	p.Tags = parseTags(strings.Join(terms, ","))
+	p.Draft = entry.Control != nil && strings.TrimSpace(entry.Control.Draft) == "yes"
+	if !p.Draft {
+		p.Scheduled = false
+	}
+	return nil
+}
+
+func atomPubMemberPath(p *Post) string {
+	u, err := routeAtomPubMember.URL("slug", p.Slug.StringID())
+	if err != nil {
+		panic(err)
+	}
+	return u.String()
+}
+
+func atomPubCollectionPath() string {
+	u, err := routeAtomPubCollection.URL()
+	if err != nil {
+		panic(err)
+	}
+	return u.String()
+}
+
+// atomPubETag identifies the version of a post, for conditional requests.
+func atomPubETag(p *Post) string {
+	return fmt.Sprintf(`"%d"`, p.Updated.UnixNano())
+}
+
+func writeXML(w http.ResponseWriter, contentType string, status int, v interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		panic(err)
+	}
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		panic(err)
+	}
+}
+
+// readAtomPubEntry parses the entry in the request's body. Responds with an
+// error and returns false if there is none.
+func readAtomPubEntry(w http.ResponseWriter, r *http.Request) (*atomPubEntry, bool) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/atom+xml" || (params["type"] != "" && params["type"] != "entry") {
+		// Media resources, e.g. images, are not supported.
+		http.Error(w, "Expected an Atom entry", http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+	entry := &atomPubEntry{}
+	if err := xml.NewDecoder(http.MaxBytesReader(w, r.Body, maxAtomPubEntrySize)).Decode(entry); err != nil {
+		http.Error(w, "Invalid Atom entry: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return entry, true
+}
+
+func atomPubServiceDocument(c context.Context, w http.ResponseWriter, r *http.Request) {
+	c, ok := requireAdminAPI(c, w, r)
+	if !ok {
+		return
+	}
+	config, site := loadFeedConfig(c, r)
+	writeXML(w, atomServiceContentType, http.StatusOK, atomPubService{
+		Workspace: atomPubWorkspace{
+			Title: config.feedTitle(),
+			Collection: atomPubCollectionDoc{
+				Href:       site + atomPubCollectionPath(),
+				Title:      atomPubCollectionTitle,
+				Accept:     atomEntryMediaType,
+				Categories: atomPubCategories{Fixed: "no"},
+			},
+		},
+	})
+}
+
+// atomPubCollection lists posts, including drafts, newest first, and creates
+// new posts.
+func atomPubCollection(c context.Context, w http.ResponseWriter, r *http.Request) {
+	c, ok := requireAdminAPI(c, w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		listAtomPubCollection(c, w, r)
+	case "POST":
+		createAtomPubMember(c, w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listAtomPubCollection(c context.Context, w http.ResponseWriter, r *http.Request) {
+	path := atomPubCollectionPath()
+	posts, nav, ok := loadPostsPage(c, w, r, allPosts, path)
+	if !ok {
+		return
+	}
+	config, site := loadFeedConfig(c, r)
+	feed := atomPubFeed{
+		ID:    config.tagURI("atompub/posts"),
+		Title: config.feedTitle() + ": " + atomPubCollectionTitle,
+		Links: []atomPubLink{{Rel: "self", Href: site + path}},
+	}
+	if nav.Self != "" {
+		feed.Links[0].Href += "?" + string(nav.Self)
+	}
+	if nav.Older != "" {
+		feed.Links = append(feed.Links, atomPubLink{Rel: "next", Href: site + path + "?" + string(nav.Older)})
+	}
+	for i := range posts {
+		feed.Entries = append(feed.Entries, newAtomPubEntry(&posts[i], config, site))
+		if posts[i].Updated.After(feed.Updated) {
+			feed.Updated = posts[i].Updated
+		}
+	}
+	writeXML(w, atomFeedContentType, http.StatusOK, feed)
+}
+
+func createAtomPubMember(c context.Context, w http.ResponseWriter, r *http.Request) {
+	entry, ok := readAtomPubEntry(w, r)
+	if !ok {
+		return
+	}
+	p := &Post{}
+	if err := entry.apply(p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.Created = time.Now().UTC()
+	p.Updated = p.Created
+	// Clients may suggest the slug, which is used unless taken.
+	var slug string
+	if hint, err := url.PathUnescape(r.Header.Get("Slug")); err == nil {
+		slug = slugHint(hint)
+	}
+	storePostWithSlug(c, p, slug)
+
+	config, site := loadFeedConfig(c, r)
+	location := site + atomPubMemberPath(p)
+	w.Header().Set("Location", location)
+	w.Header().Set("Content-Location", location)
+	w.Header().Set("ETag", atomPubETag(p))
+	writeXML(w, atomEntryContentType, http.StatusCreated, newAtomPubEntry(p, config, site))
+}
+
+// atomPubMember reads, updates and deletes single posts. Deleted posts are
+// moved to the trash.
+func atomPubMember(c context.Context, w http.ResponseWriter, r *http.Request) {
+	c, ok := requireAdminAPI(c, w, r)
+	if !ok {
+		return
+	}
+	p := loadVisiblePost(c, mux.Vars(r)["slug"])
+	if p.Trashed {
+		panic(datastore.ErrNoSuchEntity)
+	}
+	etag := atomPubETag(p)
+	if r.Method == "PUT" || r.Method == "DELETE" {
+		// Refuse to overwrite changes the client hasn't seen.
+		if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != etag {
+			http.Error(w, "The post was changed", http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		config, site := loadFeedConfig(c, r)
+		writeXML(w, atomEntryContentType, http.StatusOK, newAtomPubEntry(p, config, site))
+	case "PUT":
+		entry, ok := readAtomPubEntry(w, r)
+		if !ok {
+			return
+		}
+		if err := entry.apply(p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.Updated = time.Now().UTC()
+		storePost(c, p)
+		config, site := loadFeedConfig(c, r)
+		w.Header().Set("ETag", atomPubETag(p))
+		writeXML(w, atomEntryContentType, http.StatusOK, newAtomPubEntry(p, config, site))
+	case "DELETE":
+		trashPost(c, p)
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,107 @@
+package blog
+
+import "strings"
+
+// DiffOp describes how a line changed between two texts.
+type DiffOp string
+
+const (
+	DiffEqual  DiffOp = "equal"
+	DiffInsert DiffOp = "insert"
+	DiffDelete DiffOp = "delete"
+)
+
+// Marker returns the unified diff style prefix for the operation.
+func (op DiffOp) Marker() string {
+	switch op {
+	case DiffInsert:
+		return "+"
+	case DiffDelete:
+		return "-"
+	}
+	return " "
+}
+
+type DiffLine struct {
+	Op   DiffOp
+	Text string
+}
+
+// diffLines computes a line-by-line diff turning a into b, based on the
+// longest common subsequence of lines.
+func diffLines(a, b string) []DiffLine {
+	as := splitLines(a)
+	bs := splitLines(b)
+
+	// Trim the common prefix and suffix, which are usually most of a post.
+	prefix := 0
+	for prefix < len(as) && prefix < len(bs) && as[prefix] == bs[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(as)-prefix && suffix < len(bs)-prefix &&
+		as[len(as)-1-suffix] == bs[len(bs)-1-suffix] {
+		suffix++
+	}
+
+	result := make([]DiffLine, 0, len(as)+len(bs))
+	for _, line := range as[:prefix] {
+		result = append(result, DiffLine{DiffEqual, line})
+	}
+	result = append(result, diffMiddle(as[prefix:len(as)-suffix], bs[prefix:len(bs)-suffix])...)
+	for _, line := range as[len(as)-suffix:] {
+		result = append(result, DiffLine{DiffEqual, line})
+	}
+	return result
+}
+
+func diffMiddle(as, bs []string) []DiffLine {
+	// lcs[i][j] is the length of the longest common subsequence of as[i:] and bs[j:].
+	lcs := make([][]int, len(as)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bs)+1)
+	}
+	for i := len(as) - 1; i >= 0; i-- {
+		for j := len(bs) - 1; j >= 0; j-- {
+			if as[i] == bs[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	result := make([]DiffLine, 0, len(as)+len(bs))
+	i, j := 0, 0
+	for i < len(as) && j < len(bs) {
+		switch {
+		case as[i] == bs[j]:
+			result = append(result, DiffLine{DiffEqual, as[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			result = append(result, DiffLine{DiffDelete, as[i]})
+			i++
+		default:
+			result = append(result, DiffLine{DiffInsert, bs[j]})
+			j++
+		}
+	}
+	for ; i < len(as); i++ {
+		result = append(result, DiffLine{DiffDelete, as[i]})
+	}
+	for ; j < len(bs); j++ {
+		result = append(result, DiffLine{DiffInsert, bs[j]})
+	}
+	return result
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,373 @@
+package blog
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+)
+
+// Micropub (https://www.w3.org/TR/micropub/) lets IndieWeb clients publish
+// h-entry posts. Clients send the app password as their bearer token; the
+// blog has no IndieAuth endpoints to obtain one, so it is entered into the
+// client by hand. Session cookies are not accepted, as browsers send them
+// along with cross-site form posts.
+// Notes without a name get a title from the start of their content.
+
+const maxMicropubRequestSize = 1 << 20
+
+// micropubProperties are the properties of an h-entry. Values are strings, or
+// objects like {"html": "..."} for content.
+type micropubProperties map[string][]interface{}
+
+// text returns the first value of the property as text.
+func (props micropubProperties) text(name string) string {
+	values := props[name]
+	if len(values) == 0 {
+		return ""
+	}
+	switch v := values[0].(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case map[string]interface{}:
+		// Markdown passes HTML through, so it is the better representation.
+		if html, ok := v["html"].(string); ok {
+			return strings.TrimSpace(html)
+		}
+		if value, ok := v["value"].(string); ok {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+func (props micropubProperties) strings(name string) []string {
+	result := make([]string, 0, len(props[name]))
+	for _, value := range props[name] {
+		if s, ok := value.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// micropubRequest is a request in the JSON syntax. Form encoded requests are
+// converted to it.
+type micropubRequest struct {
+	Type       []string           `json:"type"`
+	Properties micropubProperties `json:"properties"`
+	Action     string             `json:"action"`
+	URL        string             `json:"url"`
+	Replace    micropubProperties `json:"replace"`
+	Add        micropubProperties `json:"add"`
+	// Delete lists the names of properties to delete, or maps them to the
+	// values to delete.
+	Delete json.RawMessage `json:"delete"`
+}
+
+// micropubPostProperties returns the properties of a post.
+func micropubPostProperties(p *Post, site string) micropubProperties {
+	status := "published"
+	if p.Draft {
+		status = "draft"
+	}
+	props := micropubProperties{
+		"name":        {p.Title},
+		"content":     {p.Text},
+		"post-status": {status},
+		"published":   {p.Created.Format(time.RFC3339)},
+		"updated":     {p.Updated.Format(time.RFC3339)},
+		"url":         {site + string(p.Url())},
+	}
+	if p.Excerpt != "" {
+		props["summary"] = []interface{}{p.Excerpt}
+	}
+	if len(p.Tags) > 0 {
+		props["category"] = make([]interface{}, len(p.Tags))
+		for i, tag := range p.Tags {
+			props["category"][i] = tag
+		}
+	}
+	return props
+}
+
+// applyMicropubProperties sets the post's fields from the given properties,
+// which replace all of the post's content.
+func applyMicropubProperties(p *Post, props micropubProperties) error {
+	content := props.text("content")
+	title := props.text("name")
+	if title == "" {
+		title = titleFromContent(content)
+	}
+	if title == "" {
+		return fmt.Errorf("the entry needs a name or content")
+	}
+	p.Title = title
+	p.Text = content
+	p.Excerpt = props.text("summary")
+	p.Tags = parseTags(strings.Join(props.strings("category"), ","))
+	switch status := props.text("post-status"); status {
+	case "", "published":
+		p.Draft = false
+		p.Scheduled = false
+	case "draft":
+		p.Draft = true
+	default:
+		return fmt.Errorf("unknown post-status %q", status)
+	}
+	return nil
+}
+
+// maxNoteTitleLength is the number of runes of a note's content used as its
+// title.
+const maxNoteTitleLength = 50
+
+var markupRE = regexp.MustCompile(`<[^>]*>|[*_#>` + "`" + `]`)
+
+// titleFromContent makes a title for a note from the start of its first line.
+func titleFromContent(content string) string {
+	line := strings.TrimSpace(strings.SplitN(strings.TrimSpace(content), "\n", 2)[0])
+	words := strings.Fields(markupRE.ReplaceAllString(line, ""))
+	title := ""
+	for _, word := range words {
+		if utf8.RuneCountInString(title)+1+utf8.RuneCountInString(word) > maxNoteTitleLength {
+			if title == "" {
+				return string([]rune(word)[:maxNoteTitleLength]) + "…"
+			}
+			return title + "…"
+		}
+		if title != "" {
+			title += " "
+		}
+		title += word
+	}
+	return title
+}
+
+// parseMicropubForm converts a form encoded request to the JSON syntax.
+func parseMicropubForm(form url.Values) *micropubRequest {
+	req := &micropubRequest{
+		Action:     form.Get("action"),
+		URL:        form.Get("url"),
+		Properties: make(micropubProperties),
+	}
+	if h := form.Get("h"); h != "" {
+		req.Type = []string{"h-" + h}
+	}
+	for name, values := range form {
+		switch name {
+		case "h", "action", "url", "access_token":
+			continue
+		}
+		name = strings.TrimSuffix(name, "[]")
+		for _, value := range values {
+			req.Properties[name] = append(req.Properties[name], value)
+		}
+	}
+	return req
+}
+
+func writeMicropubError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+func writeMicropubJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		panic(err)
+	}
+}
+
+func micropub(c context.Context, w http.ResponseWriter, r *http.Request) {
+	// Limits the body before the access_token parameter is looked up.
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, maxMicropubRequestSize)
+	}
+	c, ok := requireAccessToken(c, w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		queryMicropub(c, w, r)
+	case "POST":
+		postMicropub(c, w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// queryMicropub answers queries for the configuration and for the source of
+// posts.
+func queryMicropub(c context.Context, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch query.Get("q") {
+	case "config":
+		writeMicropubJSON(w, map[string]interface{}{
+			"syndicate-to": []string{},
+			"post-types": []map[string]string{
+				{"type": "note", "name": "Note"},
+				{"type": "article", "name": "Article"},
+			},
+		})
+	case "syndicate-to":
+		writeMicropubJSON(w, map[string]interface{}{"syndicate-to": []string{}})
+	case "source":
+		p, err := loadPostByURL(c, query.Get("url"))
+		if err != nil {
+			writeMicropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		_, site := loadFeedConfig(c, r)
+		props := micropubPostProperties(p, site)
+		if names := append(query["properties"], query["properties[]"]...); len(names) > 0 {
+			selected := make(micropubProperties)
+			for _, name := range names {
+				if values, ok := props[name]; ok {
+					selected[name] = values
+				}
+			}
+			writeMicropubJSON(w, map[string]interface{}{"properties": selected})
+			return
+		}
+		writeMicropubJSON(w, map[string]interface{}{"type": []string{"h-entry"}, "properties": props})
+	default:
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", "unknown query")
+	}
+}
+
+func postMicropub(c context.Context, w http.ResponseWriter, r *http.Request) {
+	var req *micropubRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		req = &micropubRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeMicropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+	} else {
+		if err := r.ParseMultipartForm(maxMicropubRequestSize); err != nil && err != http.ErrNotMultipart {
+			writeMicropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		req = parseMicropubForm(r.PostForm)
+	}
+
+	if req.Action == "" || req.Action == "create" {
+		createMicropubPost(c, w, r, req)
+		return
+	}
+	p, err := loadPostByURL(c, req.URL)
+	if err != nil {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	switch req.Action {
+	case "update":
+		updateMicropubPost(c, w, r, p, req)
+	case "delete":
+		if !p.Trashed {
+			trashPost(c, p)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "undelete":
+		// Like posts restored from the trash, the post comes back as a draft.
+		if p.Trashed {
+			restorePost(c, p)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", "unknown action "+req.Action)
+	}
+}
+
+func createMicropubPost(c context.Context, w http.ResponseWriter, r *http.Request, req *micropubRequest) {
+	if len(req.Type) > 0 && req.Type[0] != "h-entry" {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", "only h-entry is supported")
+		return
+	}
+	p := &Post{}
+	if err := applyMicropubProperties(p, req.Properties); err != nil {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	p.Created = time.Now().UTC()
+	p.Updated = p.Created
+	storePostWithSlug(c, p, slugHint(req.Properties.text("mp-slug")))
+
+	_, site := loadFeedConfig(c, r)
+	w.Header().Set("Location", site+string(p.Url()))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// updateMicropubPost replaces, adds and deletes properties of the post.
+func updateMicropubPost(c context.Context, w http.ResponseWriter, r *http.Request, p *Post, req *micropubRequest) {
+	if p.Trashed {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", "the post is deleted")
+		return
+	}
+	_, site := loadFeedConfig(c, r)
+	props := micropubPostProperties(p, site)
+	for name, values := range req.Replace {
+		props[name] = values
+	}
+	for name, values := range req.Add {
+		props[name] = append(props[name], values...)
+	}
+	if len(req.Delete) > 0 {
+		var names []string
+		var values micropubProperties
+		if err := json.Unmarshal(req.Delete, &names); err == nil {
+			for _, name := range names {
+				delete(props, name)
+			}
+		} else if err := json.Unmarshal(req.Delete, &values); err == nil {
+			for name, deleted := range values {
+				kept := props[name][:0]
+				for _, value := range props[name] {
+					if !containsValue(deleted, value) {
+						kept = append(kept, value)
+					}
+				}
+				props[name] = kept
+			}
+		} else {
+			writeMicropubError(w, http.StatusBadRequest, "invalid_request", "invalid delete")
+			return
+		}
+	}
+	if err := applyMicropubProperties(p, props); err != nil {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	p.Updated = time.Now().UTC()
+	storePost(c, p)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// containsValue returns whether the value is one of the given string values.
+func containsValue(values []interface{}, value interface{}) bool {
+	s, ok := value.(string)
+	if !ok {
+		return false
+	}
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -2,11 +2,19 @@ package blog
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/gob"
 	"fmt"
+	"hash/fnv"
 	"html/template"
 	"net/url"
+	"path"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,6 +23,7 @@ import (
 	"github.com/luci/gae/service/memcache"
 	"github.com/luci/gae/service/user"
 	"github.com/luci/luci-go/common/logging"
+	"github.com/russross/blackfriday"
 	"golang.org/x/net/context"
 )
 
@@ -29,9 +38,85 @@ type Post struct {
 	Text        string         `gae:"text,noindex"`
 	NumComments int32          `gae:"numComments,noindex"`
 	Draft       bool           `gae:"draft"`
+	Tags        []string       `gae:"tags"`
+	// Excerpt is an optional summary of the post shown on index pages. Without
+	// it, the text up to moreMarker is used.
+	Excerpt string `gae:"excerpt,noindex"`
+	// Text and summary rendered to HTML when storing the post, using the
+	// markdown configuration identified by RenderVersion.
+	RenderedText    string `gae:"renderedText,noindex"`
+	RenderedSummary string `gae:"renderedSummary,noindex"`
+	RenderVersion   int32  `gae:"renderVersion,noindex"`
+	// Trashed posts are soft-deleted. They are always drafts, so they are
+	// hidden from readers, and can be restored or purged from the trash.
+	Trashed bool `gae:"trashed"`
+	// Scheduled posts are drafts until PublishAt, when they are published by
+	// publishDuePosts.
+	Scheduled bool      `gae:"scheduled"`
+	PublishAt time.Time `gae:"publishAt"`
+	// CommentsUpdated is when comments were last approved or removed, which
+	// changes the post's pages without updating the post.
+	CommentsUpdated time.Time `gae:"commentsUpdated"`
 	Timestamps
 }
 
+// lastModified returns the later of t and the time the post or its comments
+// were last changed.
+func (p *Post) lastModified(t time.Time) time.Time {
+	for _, u := range []time.Time{p.Updated, p.CommentsUpdated} {
+		if u.After(t) {
+			t = u
+		}
+	}
+	return t
+}
+
+// moreMarker separates the summary of a post from the rest of its text.
+const moreMarker = "<!--more-->"
+
+// Summary returns the part of the post shown on index pages, or "" if the
+// whole post should be shown.
+func (p *Post) Summary() string {
+	if p.Excerpt != "" {
+		return p.Excerpt
+	}
+	if i := strings.Index(p.Text, moreMarker); i >= 0 {
+		return p.Text[:i]
+	}
+	return ""
+}
+
+// render stores the HTML for the post's text and summary.
+func (p *Post) render() {
+	p.RenderedText = string(markdown(p.Text, 0))
+	p.RenderedSummary = string(p.renderSummary())
+	p.RenderVersion = markdownVersion
+}
+
+func (p *Post) renderSummary() template.HTML {
+	if summary := p.Summary(); summary != "" {
+		return markdown(summary, 0)
+	}
+	return ""
+}
+
+// Html returns the post's text as HTML. Posts stored with an outdated
+// markdown configuration are rendered again, until rerenderPosts stores them.
+func (p Post) Html() template.HTML {
+	if p.RenderVersion != markdownVersion {
+		return markdown(p.Text, 0)
+	}
+	return template.HTML(p.RenderedText)
+}
+
+// SummaryHtml returns the post's summary as HTML.
+func (p Post) SummaryHtml() template.HTML {
+	if p.RenderVersion != markdownVersion {
+		return p.renderSummary()
+	}
+	return template.HTML(p.RenderedSummary)
+}
+
 func (p *Post) Url() template.URL {
 	return p.TemplateRoute(routeShowPost)
 }
@@ -40,6 +125,22 @@ func (p *Post) EditUrl() template.URL {
 	return p.TemplateRoute(routeEditPost)
 }
 
+func (p *Post) RevisionsUrl() template.URL {
+	return p.TemplateRoute(routeRevisions)
+}
+
+func (p *Post) PreviewsUrl() template.URL {
+	return p.TemplateRoute(routePreviews)
+}
+
+func (p *Post) CommentUrl() template.URL {
+	return p.TemplateRoute(routeAddComment)
+}
+
+func (p *Post) CommentsFeedUrl() template.URL {
+	return p.TemplateRoute(routeCommentsFeed)
+}
+
 func (p *Post) Route(route *mux.Route) *url.URL {
 	u, err := route.URL(
 		"ymd", p.Created.Format("2006/01/02"),
@@ -60,18 +161,194 @@ type Comment struct {
 	Author      string         `gae:"author,noindex"`
 	AuthorEmail string         `gae:"authorEmail,noindex"`
 	AuthorUrl   string         `gae:"authorUrl,noindex"`
-	Kind        string         `gae:"kind,noindex"`
-	Text        string         `gae:"text,noindex"`
-	Approved    bool           `gae:"approved,noindex"`
+	// Kind is empty for comments made on the blog, see commentKind*.
+	Kind string `gae:"kind,noindex"`
+	// Source is the page that sent a webmention. It is indexed to find
+	// earlier mentions from the same page.
+	Source string `gae:"source"`
+	// Text of the comment in markdown. For webmentions, the plain text of a
+	// reply, or the title of the page mentioning the post.
+	Text     string `gae:"text,noindex"`
+	Approved bool   `gae:"approved"`
+	Rejected bool   `gae:"rejected"`
+	// Text rendered to HTML, see Post.RenderedText.
+	RenderedText  string `gae:"renderedText,noindex"`
+	RenderVersion int32  `gae:"renderVersion,noindex"`
 	Timestamps
 }
 
+// Kinds of webmentions received from other sites.
+const (
+	commentKindReply   = "reply"
+	commentKindLike    = "like"
+	commentKindMention = "mention"
+)
+
+func (comment *Comment) render() {
+	if comment.Source != "" {
+		// Text from other sites is not markdown.
+		comment.RenderedText = "<p>" + template.HTMLEscapeString(comment.Text) + "</p>"
+		comment.RenderVersion = markdownVersion
+		return
+	}
+	// Essentially just adds rel=nofollow over regular markdown.
+	comment.RenderedText = string(markdown(comment.Text, blackfriday.HTML_NOFOLLOW_LINKS))
+	comment.RenderVersion = markdownVersion
+}
+
+// Html returns the comment's text as HTML.
+func (comment Comment) Html() template.HTML {
+	if comment.RenderVersion != markdownVersion {
+		comment.render()
+	}
+	return template.HTML(comment.RenderedText)
+}
+
+// PendingComment is a comment awaiting moderation, along with the post it
+// was made on.
+type PendingComment struct {
+	Comment
+	Post *Post
+}
+
+// A Revision is a snapshot of a post's content, stored as a child entity of
+// the post whenever the post is saved.
+type Revision struct {
+	Key     *datastore.Key `gae:"$key"`
+	Title   string         `gae:"title,noindex"`
+	Text    string         `gae:"text,noindex"`
+	Draft   bool           `gae:"draft,noindex"`
+	Editor  string         `gae:"editor,noindex"`
+	Created time.Time      `gae:"created"`
+}
+
+// SlugRedirect records a slug that a post was renamed from, so that links to
+// the old URL keep working.
+type SlugRedirect struct {
+	Slug   *datastore.Key `gae:"$key"`
+	Target *datastore.Key `gae:"target,noindex"`
+}
+
+// PostsChanged records when posts last changed, including changes that hide
+// them, e.g. moving them to the trash. There is a single PostsChanged entity.
+type PostsChanged struct {
+	Key  *datastore.Key `gae:"$key"`
+	Time time.Time      `gae:"time,noindex"`
+}
+
+// Config holds the blog's settings. There is a single Config entity.
+type Config struct {
+	Key *datastore.Key `gae:"$key"`
+	// PreviewSecret signs preview links for drafts.
+	PreviewSecret []byte `gae:"previewSecret,noindex"`
+	// FormSecret signs the tokens that the admin's forms are posted with, see
+	// formToken.
+	FormSecret []byte `gae:"formSecret,noindex"`
+	// FeedSummaries makes feeds contain post summaries instead of full posts.
+	FeedSummaries bool `gae:"feedSummaries,noindex"`
+	// BaseURL is the scheme and host the blog is served from, e.g.
+	// "https://www.example.com". Defaults to the host of the request.
+	BaseURL string `gae:"baseURL,noindex"`
+	// FeedTitle and FeedAuthor describe the blog in feeds.
+	FeedTitle  string `gae:"feedTitle,noindex"`
+	FeedAuthor string `gae:"feedAuthor,noindex"`
+	// TagAuthority is the "authority,date" part of the tag URIs (RFC 4151)
+	// that identify feeds and their entries. It is set from BaseURL once, or
+	// in the settings, so that the IDs stay the same when the blog moves to
+	// another domain.
+	TagAuthority string `gae:"tagAuthority,noindex"`
+	// AppPasswordHash is the salted hash of the password that authenticates
+	// editors using the publishing APIs, which cannot sign in as admins.
+	AppPasswordSalt []byte `gae:"appPasswordSalt,noindex"`
+	AppPasswordHash []byte `gae:"appPasswordHash,noindex"`
+	// CommentsMigrated is set once all comments have been stored with indexed
+	// approved and rejected properties, see migrateComments.
+	CommentsMigrated bool `gae:"commentsMigrated,noindex"`
+	// PostsMigrated is set once all posts have been stored with an indexed
+	// trashed property, see migratePosts.
+	PostsMigrated bool `gae:"postsMigrated,noindex"`
+	// RenderVersion is the markdownVersion that all posts and comments have
+	// been rendered with, see rerenderPosts.
+	RenderVersion int32 `gae:"renderVersion,noindex"`
+}
+
+const (
+	defaultFeedTitle  = "Martin Probst's blog"
+	defaultFeedAuthor = "Martin Probst"
+)
+
+func (config *Config) feedTitle() string {
+	if config.FeedTitle == "" {
+		return defaultFeedTitle
+	}
+	return config.FeedTitle
+}
+
+func (config *Config) feedAuthor() string {
+	if config.FeedAuthor == "" {
+		return defaultFeedAuthor
+	}
+	return config.FeedAuthor
+}
+
+// tagURI returns the tag URI identifying specific, e.g. "post/hello-world".
+func (config *Config) tagURI(specific string) string {
+	return "tag:" + config.TagAuthority + ":" + specific
+}
+
+// Media is a file uploaded through the publishing APIs, e.g. an image in a
+// post. It is stored in the datastore, so it must be smaller than an entity's
+// limit of 1 MB.
+type Media struct {
+	Key         *datastore.Key `gae:"$key"`
+	ContentType string         `gae:"contentType,noindex"`
+	Data        []byte         `gae:"data,noindex"`
+	Created     time.Time      `gae:"created,noindex"`
+}
+
+// maxMediaSize leaves room for the other properties of a Media entity.
+const maxMediaSize = 1000 * 1000
+
+func (m *Media) Url() string {
+	u, err := routeMedia.URL("name", m.Key.StringID())
+	if err != nil {
+		panic(err)
+	}
+	return u.String()
+}
+
+// PreviewToken allows viewing a draft without being an admin until it expires
+// or is deleted. Tokens are stored below their post.
+type PreviewToken struct {
+	Key     *datastore.Key `gae:"$key"`
+	Expires time.Time      `gae:"expires,noindex"`
+	Creator string         `gae:"creator,noindex"`
+	Created time.Time      `gae:"created,noindex"`
+}
+
+// PreviewLink is a preview token along with its signed URL.
+type PreviewLink struct {
+	PreviewToken
+	Url template.URL
+}
+
 const (
 	PostEntity          = "blog_post"
 	CommentEntity       = "blog_comment"
+	RevisionEntity      = "blog_post_revision"
+	SlugRedirectEntity  = "blog_slug_redirect"
+	ConfigEntity        = "blog_config"
+	PreviewTokenEntity  = "blog_preview_token"
+	MediaEntity         = "blog_media"
+	PostsChangedEntity  = "blog_posts_changed"
 	postsPerPage        = 10
+	commentsPerPage     = 20
 	postCountCacheKey   = "blog_post_count"
 	lastUpdatedCacheKey = "blog_last_updated"
+	tagCountsCacheKey   = "blog_tag_counts"
+	archiveCacheKey     = "blog_archive_months"
+	frontPageCacheKey   = "blog_post_page-0"
+	cacheGenerationKey  = "blog_cache_generation"
 )
 
 func memcacheGet(c context.Context, key string, value interface{}) error {
@@ -93,70 +370,385 @@ func memcacheSet(c context.Context, key string, value interface{}, expiration ti
 	return memcache.Set(c, it)
 }
 
-// loadPosts loads the given page of posts (1-based).
-func loadPosts(c context.Context, page int) []Post {
-	posts := make([]Post, 0, postsPerPage)
+// A postSelection is a subset of posts that is listed in pages, e.g. all posts,
+// all posts with a given tag, or all posts from a given month.
+type postSelection struct {
+	// Tag restricts the selection to posts with the given tag, if set.
+	Tag string
+	// Year, Month and Day restrict the selection to posts created in that
+	// period (UTC), if set. Month and Day are optional.
+	Year, Month, Day int
+}
+
+var allPosts = postSelection{}
+
+func (s postSelection) query() *datastore.Query {
+	q := datastore.NewQuery(PostEntity)
+	if s.Tag != "" {
+		q = q.Eq("tags", s.Tag)
+	}
+	if s.Year != 0 {
+		start, end := s.span()
+		q = q.Gte("created", start).Lt("created", end)
+	}
+	return q
+}
+
+// span returns the period of time covered by an archive selection.
+func (s postSelection) span() (start, end time.Time) {
+	switch {
+	case s.Day != 0:
+		start = time.Date(s.Year, time.Month(s.Month), s.Day, 0, 0, 0, 0, time.UTC)
+		end = start.AddDate(0, 0, 1)
+	case s.Month != 0:
+		start = time.Date(s.Year, time.Month(s.Month), 1, 0, 0, 0, 0, time.UTC)
+		end = start.AddDate(0, 1, 0)
+	default:
+		start = time.Date(s.Year, time.January, 1, 0, 0, 0, 0, time.UTC)
+		end = start.AddDate(1, 0, 0)
+	}
+	return start, end
+}
+
+// periodContaining returns the archive selection with the same granularity
+// as s that contains t.
+func (s postSelection) periodContaining(t time.Time) postSelection {
+	t = t.UTC()
+	period := postSelection{Year: t.Year()}
+	if s.Month != 0 {
+		period.Month = int(t.Month())
+	}
+	if s.Day != 0 {
+		period.Day = t.Day()
+	}
+	return period
+}
+
+// cached returns whether pages and counts of the selection are cached. Only
+// the main index is busy enough to be worth the invalidation trouble.
+func (s postSelection) cached() bool {
+	return s == allPosts
+}
+
+// path returns the path of the selection, relative to the base URI.
+func (s postSelection) path() string {
+	switch {
+	case s.Tag != "":
+		return "tag/" + s.Tag + "/"
+	case s.Day != 0:
+		return fmt.Sprintf("%04d/%02d/%02d/", s.Year, s.Month, s.Day)
+	case s.Month != 0:
+		return fmt.Sprintf("%04d/%02d/", s.Year, s.Month)
+	case s.Year != 0:
+		return fmt.Sprintf("%04d/", s.Year)
+	}
+	return ""
+}
+
+func (s postSelection) title() string {
+	switch {
+	case s.Tag != "":
+		return "Posts tagged " + s.Tag
+	case s.Year != 0:
+		return "Posts from " + s.periodName()
+	}
+	return ""
+}
+
+func (s postSelection) periodName() string {
+	start, _ := s.span()
+	switch {
+	case s.Day != 0:
+		return start.Format("January 2, 2006")
+	case s.Month != 0:
+		return start.Format("January 2006")
+	}
+	return start.Format("2006")
+}
+
+// A pageCursor selects a page of posts by the creation time of the posts
+// next to it, so that the URLs of pages stay stable when new posts are added.
+// The zero cursor selects the newest posts.
+type pageCursor struct {
+	// Before selects the posts created before the time, After the posts
+	// created after it.
+	Before, After time.Time
+	// Slug is the slug of the post next to the page. Posts created at the
+	// same time are listed in the order of their slugs, so it selects those
+	// that belong to the page, too.
+	Slug string
+}
+
+// oldestPosts selects the page with the oldest posts.
+var oldestPosts = pageCursor{After: time.Unix(0, 0)}
+
+func (cur pageCursor) isZero() bool {
+	return cur.Before.IsZero() && cur.After.IsZero()
+}
+
+// queryString returns the URL query string that selects the page.
+func (cur pageCursor) queryString() string {
+	var query string
+	switch {
+	case !cur.Before.IsZero():
+		query = fmt.Sprintf("before=%d", cur.Before.UnixNano())
+	case !cur.After.IsZero():
+		query = fmt.Sprintf("after=%d", cur.After.UnixNano())
+	default:
+		return ""
+	}
+	if cur.Slug != "" {
+		query += "&slug=" + url.QueryEscape(cur.Slug)
+	}
+	return query
+}
+
+// parsePageCursor parses the cursor from a URL query, see queryString.
+func parsePageCursor(query url.Values) (pageCursor, error) {
+	var cur pageCursor
+	for param, t := range map[string]*time.Time{"before": &cur.Before, "after": &cur.After} {
+		if v := query.Get(param); v != "" {
+			nanos, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return cur, err
+			}
+			*t = time.Unix(0, nanos).UTC()
+		}
+	}
+	if !cur.Before.IsZero() && !cur.After.IsZero() {
+		return cur, fmt.Errorf("page cursor with both before and after: %v", query)
+	}
+	cur.Slug = query.Get("slug")
+	return cur, nil
+}
+
+// loadPosts loads the page of posts selected by the cursor, newest first. It
+// also returns the cursors of the adjacent newer and older pages, or nil if
+// there are none.
+func loadPosts(c context.Context, sel postSelection, cur pageCursor) (posts []Post, newer, older *pageCursor) {
+	if !cur.After.IsZero() {
+		posts = queryNewerPosts(c, sel, cur)
+		if len(posts) <= postsPerPage {
+			// Reached the newest posts, fill the page up with older ones.
+			return loadPosts(c, sel, pageCursor{})
+		}
+		posts = posts[:postsPerPage]
+		for i, j := 0, len(posts)-1; i < j; i, j = i+1, j-1 {
+			posts[i], posts[j] = posts[j], posts[i]
+		}
+		return posts, newerCursor(posts), olderCursor(posts)
+	}
 
-	cacheKey := pageCacheKey(page - 1)
-	if !user.IsAdmin(c) {
-		err := memcacheGet(c, cacheKey, &posts)
+	// Only the front page is cached, it gets most of the traffic. Admins see
+	// drafts, so their view is never cached.
+	cached := cur.isZero() && sel.cached() && !isAdmin(c)
+	var cacheKey string
+	var err error = memcache.ErrCacheMiss
+	if cached {
+		cacheKey = postCacheKey(c, frontPageCacheKey)
+		err = memcacheGet(c, cacheKey, &posts)
 		if err == nil {
 			logging.Infof(c, "Serving cached posts page")
-			return posts
-		}
-		if err != memcache.ErrCacheMiss {
+		} else if err != memcache.ErrCacheMiss {
 			logging.Errorf(c, "Error trying to read page cache: %s, proceeding.", err)
 		}
 	}
-
-	q := datastore.NewQuery(PostEntity).
-		Order("-created").
-		Offset(int32((page - 1) * postsPerPage)).
-		Limit(postsPerPage)
-	q = filterDraft(c, q)
-	err := datastore.GetAll(c, q, &posts)
 	if err != nil {
-		panic(err)
+		if cur.isZero() {
+			posts = queryPosts(c, sel.query().Order("-created"))
+		} else {
+			posts = queryOlderPosts(c, sel, cur)
+		}
+		if cached {
+			memcacheSet(c, cacheKey, posts, 0)
+		}
+	}
+
+	if len(posts) > postsPerPage {
+		posts = posts[:postsPerPage]
+		older = olderCursor(posts)
+	}
+	if !cur.isZero() && len(posts) > 0 {
+		newer = newerCursor(posts)
+	}
+	return posts, newer, older
+}
+
+// olderCursor returns the cursor of the page after the given page of posts.
+func olderCursor(posts []Post) *pageCursor {
+	last := posts[len(posts)-1]
+	return &pageCursor{Before: last.Created, Slug: last.Slug.StringID()}
+}
+
+// newerCursor returns the cursor of the page before the given page of posts.
+func newerCursor(posts []Post) *pageCursor {
+	return &pageCursor{After: posts[0].Created, Slug: posts[0].Slug.StringID()}
+}
+
+// queryOlderPosts loads one more post than fits on a page of the posts that
+// come after the cursor, newest first. Posts created at the same time are
+// in the order of their slugs, as the datastore sorts them by key.
+func queryOlderPosts(c context.Context, sel postSelection, cur pageCursor) []Post {
+	var posts []Post
+	if cur.Slug != "" {
+		for _, p := range postsCreatedAt(c, sel, cur.Before) {
+			if p.Slug.StringID() > cur.Slug {
+				posts = append(posts, p)
+			}
+		}
+	}
+	posts = append(posts, queryPosts(c, sel.query().Lt("created", cur.Before).Order("-created"))...)
+	if len(posts) > postsPerPage+1 {
+		posts = posts[:postsPerPage+1]
+	}
+	return posts
+}
+
+// queryNewerPosts loads one more post than fits on a page of the posts that
+// come before the cursor, oldest first.
+func queryNewerPosts(c context.Context, sel postSelection, cur pageCursor) []Post {
+	var posts []Post
+	if cur.Slug != "" {
+		ties := postsCreatedAt(c, sel, cur.After)
+		for i := len(ties) - 1; i >= 0; i-- {
+			if ties[i].Slug.StringID() < cur.Slug {
+				posts = append(posts, ties[i])
+			}
+		}
+	}
+	// The datastore sorts posts created at the same time by key in both
+	// directions, so they have to be sorted again. All posts created at the
+	// time of the last one are needed for that.
+	newer := queryPosts(c, sel.query().Gt("created", cur.After).Order("created"))
+	if len(newer) > postsPerPage {
+		last := newer[len(newer)-1].Created
+		for len(newer) > 0 && newer[len(newer)-1].Created.Equal(last) {
+			newer = newer[:len(newer)-1]
+		}
+		newer = append(newer, postsCreatedAt(c, sel, last)...)
+	}
+	sort.SliceStable(newer, func(i, j int) bool {
+		if !newer[i].Created.Equal(newer[j].Created) {
+			return newer[i].Created.Before(newer[j].Created)
+		}
+		return newer[i].Slug.StringID() > newer[j].Slug.StringID()
+	})
+	posts = append(posts, newer...)
+	if len(posts) > postsPerPage+1 {
+		posts = posts[:postsPerPage+1]
+	}
+	return posts
+}
+
+// postsCreatedAt loads the selected posts created at the given time, in the
+// order of their slugs.
+func postsCreatedAt(c context.Context, sel postSelection, t time.Time) []Post {
+	if sel.Year != 0 {
+		if start, end := sel.span(); t.Before(start) || !t.Before(end) {
+			return nil
+		}
+	}
+	q := datastore.NewQuery(PostEntity).Eq("created", t)
+	if sel.Tag != "" {
+		q = q.Eq("tags", sel.Tag)
 	}
+	return getPosts(c, q)
+}
 
-	memcacheSet(c, cacheKey, posts, 0)
+// queryPosts loads one more post than fits on a page from the query, which
+// tells whether there is another page.
+func queryPosts(c context.Context, q *datastore.Query) []Post {
+	return getPosts(c, q.Limit(postsPerPage+1))
+}
 
+// getPosts loads the posts from the query that the user may see.
+func getPosts(c context.Context, q *datastore.Query) []Post {
+	posts := make([]Post, 0, postsPerPage+1)
+	if err := datastore.GetAll(c, filterVisible(c, q), &posts); err != nil {
+		panic(err)
+	}
+	if isAdmin(c) && !loadConfig(c).PostsMigrated {
+		// Posts stored before the trash existed cannot be queried by it yet.
+		visible := posts[:0]
+		for _, p := range posts {
+			if !p.Trashed {
+				visible = append(visible, p)
+			}
+		}
+		return visible
+	}
 	return posts
 }
 
-func pageCacheKey(page int) string {
-	return fmt.Sprintf("blog_post_page-%d", page)
+// legacyPageCursor finds the cursor for a page of posts by its number
+// (1-based), as used in URLs before pages were selected by cursors.
+func legacyPageCursor(c context.Context, sel postSelection, page int) pageCursor {
+	if page <= 1 {
+		return pageCursor{}
+	}
+	if page > getPageCount(c, sel) {
+		panic(datastore.ErrNoSuchEntity)
+	}
+	// The page starts below the last post of the previous page.
+	posts := make([]Post, 0, 1)
+	q := sel.query().
+		Order("-created").
+		Offset(int32((page-1)*postsPerPage - 1)).
+		Limit(1)
+	if err := datastore.GetAll(c, filterVisible(c, q), &posts); err != nil {
+		panic(err)
+	}
+	if len(posts) == 0 {
+		panic(datastore.ErrNoSuchEntity)
+	}
+	return *olderCursor(posts)
 }
 
+// pageLastUpdated returns when the listings and feeds last changed.
 func pageLastUpdated(c context.Context) time.Time {
 	var lastUpdated time.Time
-	err := memcacheGet(c, lastUpdatedCacheKey, &lastUpdated)
+	cacheKey := postCacheKey(c, lastUpdatedCacheKey)
+	err := memcacheGet(c, cacheKey, &lastUpdated)
 	if err == nil {
 		return lastUpdated
 	}
 
-	q := datastore.NewQuery(PostEntity).
-		Order("-updated").
-		Limit(1)
-	q = filterDraft(c, q)
-	posts := make([]Post, 0, 1)
-	if err := datastore.GetAll(c, q, &posts); err != nil {
+	changed := &PostsChanged{Key: postsChangedKey(c)}
+	if err := datastore.Get(c, changed); err == datastore.ErrNoSuchEntity {
+		// Posts changed at some unknown time, so start counting now.
+		changed = touchPostsChanged(c)
+	} else if err != nil {
 		panic(err)
 	}
-	if len(posts) < 1 {
-		return time.Unix(0, 0)
-	}
-	lastUpdated = posts[0].Updated
+	lastUpdated = changed.Time
 	// Ok to fail.
-	memcacheSet(c, lastUpdatedCacheKey, lastUpdated, 0)
+	memcacheSet(c, cacheKey, lastUpdated, 0)
 	logging.Infof(c, "Last Updated %s", lastUpdated)
 	return lastUpdated
 }
 
-func filterDraft(c context.Context, q *datastore.Query) *datastore.Query {
-	if !user.IsAdmin(c) {
+func postsChangedKey(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, PostsChangedEntity, "posts", 0, nil)
+}
+
+// touchPostsChanged records that posts changed now.
+func touchPostsChanged(c context.Context) *PostsChanged {
+	changed := &PostsChanged{Key: postsChangedKey(c), Time: time.Now().UTC()}
+	if err := datastore.Put(c, changed); err != nil {
+		panic(err)
+	}
+	return changed
+}
+
+// filterVisible restricts the query to the posts the user may see, i.e. the
+// published posts, or all posts but the trash for admins.
+func filterVisible(c context.Context, q *datastore.Query) *datastore.Query {
+	if !isAdmin(c) {
 		return q.Eq("draft", false)
 	}
+	if loadConfig(c).PostsMigrated {
+		return q.Eq("trashed", false)
+	}
 	return q
 }
 
@@ -164,103 +756,1013 @@ func createSlug(c context.Context, slugString string) *datastore.Key {
 	return datastore.NewKey(c, PostEntity, slugString, 0, nil)
 }
 
-func loadPost(c context.Context, slugString string) (*Post, []Comment) {
-	slug := createSlug(c, slugString)
-	p := &Post{Slug: slug}
-
+// loadVisiblePost loads the post with the given slug, if the user may see it.
+func loadVisiblePost(c context.Context, slugString string) *Post {
+	p := &Post{Slug: createSlug(c, slugString)}
 	err := datastore.Get(c, p)
 	if err != nil {
 		panic(err)
 	}
-	if p.Draft && !user.IsAdmin(c) {
+	if p.Draft && !isAdmin(c) {
 		// Drafts 404 for non-admin users
 		panic(datastore.ErrNoSuchEntity)
 	}
+	return p
+}
+
+// postPathRE matches the paths of posts, capturing the slug.
+var postPathRE = regexp.MustCompile(`^` + baseUri + `\d{4}/\d{1,2}/\d{1,2}/([^/]+)/?$`)
+
+// loadPostByURL loads the post with the given URL, which must be on this
+// blog.
+func loadPostByURL(c context.Context, postURL string) (*Post, error) {
+	u, err := url.Parse(postURL)
+	if err != nil {
+		return nil, err
+	}
+	match := postPathRE.FindStringSubmatch(u.Path)
+	if match == nil {
+		return nil, fmt.Errorf("%s is not a post on this blog", postURL)
+	}
+	p := &Post{Slug: createSlug(c, match[1])}
+	if err := datastore.Get(c, p); err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("there is no post at %s", postURL)
+	} else if err != nil {
+		panic(err)
+	}
+	return p, nil
+}
+
+// loadPostIfExists is like loadPost, but returns a nil post if there is no
+// post the user may see under the slug.
+func loadPostIfExists(c context.Context, slugString string) (p *Post, comments []Comment) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			if recovered != datastore.ErrNoSuchEntity {
+				panic(recovered)
+			}
+			p, comments = nil, nil
+		}
+	}()
+	return loadPost(c, slugString)
+}
+
+func loadPost(c context.Context, slugString string) (*Post, []Comment) {
+	p := loadVisiblePost(c, slugString)
+	slug := p.Slug
 
 	comments := make([]Comment, 0, p.NumComments)
 	q := datastore.NewQuery(CommentEntity).
 		Ancestor(slug).
 		Order("created")
+	migrated := loadConfig(c).CommentsMigrated
+	if !isAdmin(c) && migrated {
+		// Unapproved comments are only visible to admins.
+		q = q.Eq("approved", true)
+	}
 	if err := datastore.GetAll(c, q, &comments); err != nil {
 		panic(err)
 	}
-	if actualCount := int32(len(comments)); p.NumComments != actualCount {
+	if !isAdmin(c) && !migrated {
+		// Comments stored before moderation existed are missing from the
+		// approved index, so filter them here.
+		approved := comments[:0]
+		for _, comment := range comments {
+			if comment.Approved {
+				approved = append(approved, comment)
+			}
+		}
+		comments = approved
+	}
+	var actualCount int32
+	for _, comment := range comments {
+		if comment.Approved {
+			actualCount++
+		}
+	}
+	if p.NumComments != actualCount && migrated {
 		// Somehow comment count got out of sync with post.NumComments,
-		// fix the situation by storing post again.
+		// fix the situation by storing post again. This is not an edit, so
+		// don't go through storePost, which would record a revision.
 		logging.Warningf(c, "Post with incorrect comment count %s: %d != %d",
 			p.Url(), p.NumComments, actualCount)
 		p.NumComments = actualCount
-		storePost(c, p)
+		p.CommentsUpdated = time.Now().UTC()
+		if err := datastore.Put(c, p); err != nil {
+			panic(err)
+		}
+		invalidatePostCaches(c)
 	}
 	return p, comments
 }
 
-// Counts posts and caches the result.
-func getPageCount(c context.Context) int {
-	var count int64
-	err := memcacheGet(c, postCountCacheKey, &count)
-	if err == nil {
-		return int(count/postsPerPage) + 1
+// adjacentPeriods finds the closest archive periods before and after the given
+// archive selection that contain posts. Either is nil if there is none.
+func adjacentPeriods(c context.Context, sel postSelection) (newer, older *postSelection) {
+	start, end := sel.span()
+	find := func(q *datastore.Query) *postSelection {
+		posts := make([]Post, 0, 1)
+		if err := datastore.GetAll(c, filterVisible(c, q.Limit(1)), &posts); err != nil {
+			panic(err)
+		}
+		if len(posts) == 0 {
+			return nil
+		}
+		period := sel.periodContaining(posts[0].Created)
+		return &period
 	}
+	newer = find(datastore.NewQuery(PostEntity).Gte("created", end).Order("created"))
+	older = find(datastore.NewQuery(PostEntity).Lt("created", start).Order("-created"))
+	return newer, older
+}
+
+// ArchiveMonth is a month with published posts in the archive overview.
+type ArchiveMonth struct {
+	Year  int
+	Month time.Month
+	Count int
+}
+
+func (m ArchiveMonth) Path() string {
+	return postSelection{Year: m.Year, Month: int(m.Month)}.path()
+}
+
+// ArchiveYear groups the months with published posts in a year, newest first.
+type ArchiveYear struct {
+	Year   int
+	Count  int
+	Months []ArchiveMonth
+}
+
+func (y ArchiveYear) Path() string {
+	return postSelection{Year: y.Year}.path()
+}
 
-	// Cache misses, but also memcache not available etc.
+// loadArchive counts the published posts in each month, newest first.
+func loadArchive(c context.Context) []ArchiveYear {
+	var years []ArchiveYear
+	cacheKey := postCacheKey(c, archiveCacheKey)
+	err := memcacheGet(c, cacheKey, &years)
+	if err == nil {
+		return years
+	}
 	if err != memcache.ErrCacheMiss {
-		logging.Errorf(c, "Error trying to read page count: %s, proceeding.", err)
+		logging.Errorf(c, "Error trying to read archive: %s, proceeding.", err)
 	}
 
-	count, err = datastore.Count(c, datastore.NewQuery(PostEntity))
-	if err != nil {
+	q := datastore.NewQuery(PostEntity).
+		Eq("draft", false).
+		Project("created").
+		Order("-created")
+	projected := make([]Post, 0)
+	if err := datastore.GetAll(c, q, &projected); err != nil {
 		panic(err)
 	}
-	logging.Infof(c, "Counted %v posts", count)
-	// Ignore potential error
-	memcacheSet(c, postCountCacheKey, count, 1*time.Hour)
 
-	return int(count/postsPerPage) + 1
+	years = make([]ArchiveYear, 0)
+	for _, p := range projected {
+		created := p.Created.UTC()
+		if len(years) == 0 || years[len(years)-1].Year != created.Year() {
+			years = append(years, ArchiveYear{Year: created.Year()})
+		}
+		year := &years[len(years)-1]
+		year.Count++
+		if len(year.Months) == 0 || year.Months[len(year.Months)-1].Month != created.Month() {
+			year.Months = append(year.Months, ArchiveMonth{Year: year.Year, Month: created.Month()})
+		}
+		year.Months[len(year.Months)-1].Count++
+	}
+	// Ok to fail.
+	memcacheSet(c, cacheKey, years, 1*time.Hour)
+	return years
 }
 
-func storePost(c context.Context, p *Post) {
-	newPost := p.Slug == nil
-
-	err := datastore.RunInTransaction(c, func(c context.Context) error {
-		if newPost {
-			slug := slugify(c, p)
-			p.Slug = slug
+// Counts published posts in the selection and returns the number of pages
+// they fill, at least one. The count of all posts is cached.
+func getPageCount(c context.Context, sel postSelection) int {
+	var count int64
+	if sel.cached() {
+		cacheKey := postCacheKey(c, postCountCacheKey)
+		err := memcacheGet(c, cacheKey, &count)
+		if err == nil {
+			return pagesFor(count)
 		}
-		if err := datastore.Put(c, p); err != nil {
-			return err
+
+		// Cache misses, but also memcache not available etc.
+		if err != memcache.ErrCacheMiss {
+			logging.Errorf(c, "Error trying to read page count: %s, proceeding.", err)
 		}
-		return nil
-	}, &datastore.TransactionOptions{XG: true})
+		count = loadPublishedPostCount(c)
+		// Ignore potential error
+		memcacheSet(c, cacheKey, count, 1*time.Hour)
+		return pagesFor(count)
+	}
 
+	count, err := datastore.Count(c, sel.query().Eq("draft", false))
 	if err != nil {
 		panic(err)
 	}
+	logging.Infof(c, "Counted %v posts", count)
+	return pagesFor(count)
+}
 
-	if newPost {
-		logging.Infof(c, "Resetting blog_page_count")
-		memcache.Delete(c, postCountCacheKey)
-
-		pages := getPageCount(c)
-		pageCacheKeys := make([]string, pages)
-		for i := 0; i < pages; i++ {
-			pageCacheKeys[i] = pageCacheKey(i)
-		}
-		logging.Infof(c, "Deleting page caches %s", pageCacheKeys)
-		memcache.Delete(c, pageCacheKeys...)
+func pagesFor(count int64) int {
+	if count == 0 {
+		return 1 // An empty blog still has a front page.
 	}
+	return int((count + postsPerPage - 1) / postsPerPage)
 }
 
-func storeComment(c context.Context, p *Post, comment *Comment) error {
-	newComment := comment.Key == nil
-	if p.Slug == nil {
-		return fmt.Errorf("Cannot store comment on new post")
-	}
+// CounterShard holds part of a sharded counter, which is the sum of all its
+// shards. Updates spread over the shards, so that they rarely conflict.
+type CounterShard struct {
+	Key   *datastore.Key `gae:"$key"`
+	Count int64          `gae:"count,noindex"`
+}
+
+const (
+	CounterShardEntity = "blog_counter_shard"
+	// The published post counter consists of a base, which is set by counting
+	// the posts, and counterShards shards for updates.
+	publishedPostsCounter = "published_posts"
+	counterShards         = 5
+)
+
+func publishedPostsBaseKey(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, CounterShardEntity, publishedPostsCounter, 0, nil)
+}
+
+func publishedPostsShardKey(c context.Context, shard int) *datastore.Key {
+	return datastore.NewKey(c, CounterShardEntity, fmt.Sprintf("%s-%d", publishedPostsCounter, shard), 0, nil)
+}
+
+// updatePublishedPostCount adds delta to the count of published posts, on the
+// shard of the given post. Must run in a cross group transaction. Shards are
+// updated even before the counter is initialized, initializing takes them
+// into account.
+func updatePublishedPostCount(c context.Context, slug *datastore.Key, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(slug.StringID()))
+	shard := &CounterShard{Key: publishedPostsShardKey(c, int(h.Sum32()%counterShards))}
+	if err := datastore.Get(c, shard); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	shard.Count += delta
+	return datastore.Put(c, shard)
+}
+
+// sumPublishedPostShards sums up the shards of the published post counter,
+// without the base.
+func sumPublishedPostShards(c context.Context) (int64, error) {
+	var sum int64
+	for i := 0; i < counterShards; i++ {
+		shard := &CounterShard{Key: publishedPostsShardKey(c, i)}
+		if err := datastore.Get(c, shard); err == nil {
+			sum += shard.Count
+		} else if err != datastore.ErrNoSuchEntity {
+			return 0, err
+		}
+	}
+	return sum, nil
+}
+
+// loadPublishedPostCount sums up the shards of the published post counter,
+// initializing it on first use.
+func loadPublishedPostCount(c context.Context) int64 {
+	base := &CounterShard{Key: publishedPostsBaseKey(c)}
+	err := datastore.Get(c, base)
+	if err == datastore.ErrNoSuchEntity {
+		return rebuildPublishedPostCount(c)
+	} else if err != nil {
+		panic(err)
+	}
+
+	sum, err := sumPublishedPostShards(c)
+	if err != nil {
+		panic(err)
+	}
+	count := base.Count + sum
+	logging.Infof(c, "Counted %v posts", count)
+	return count
+}
+
+// rebuildPublishedPostCount counts the published posts, and sets the base of
+// the counter so that it adds up to the count with the shards. The count
+// query is eventually consistent, so posts published or unpublished while it
+// runs may be miscounted. Cron rebuilds the counter regularly to correct that.
+func rebuildPublishedPostCount(c context.Context) int64 {
+	count, err := datastore.Count(c, datastore.NewQuery(PostEntity).Eq("draft", false))
+	if err != nil {
+		panic(err)
+	}
+	base := &CounterShard{Key: publishedPostsBaseKey(c)}
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		sum, err := sumPublishedPostShards(c)
+		if err != nil {
+			return err
+		}
+		base.Count = count - sum
+		return datastore.Put(c, base)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		panic(err)
+	}
+	logging.Infof(c, "Rebuilt published post counter with %d posts", count)
+	return count
+}
+
+func storePost(c context.Context, p *Post) {
+	storePostWithSlug(c, p, "")
+}
+
+// storePostWithSlug stores the post like storePost. A new post gets the given
+// slug, unless it is empty or taken, in which case the slug is derived from
+// the title.
+func storePostWithSlug(c context.Context, p *Post, slug string) {
+	newPost := p.Slug == nil
+	if p.Trashed || p.Scheduled {
+		p.Draft = true
+	}
+	p.render()
+
+	var delta int64
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		wasPublished := false
+		if newPost {
+			p.Slug = slugify(c, p, slug)
+			// The slug may have belonged to a renamed post, whose redirect
+			// would otherwise hide the new post.
+			redirect := datastore.NewKey(c, SlugRedirectEntity, p.Slug.StringID(), 0, nil)
+			if err := datastore.Delete(c, redirect); err != nil {
+				return err
+			}
+		} else {
+			old := &Post{Slug: p.Slug}
+			if err := datastore.Get(c, old); err == nil {
+				wasPublished = !old.Draft
+			} else if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+		if err := datastore.Put(c, p); err != nil {
+			return err
+		}
+		if err := datastore.Put(c, newRevision(c, p)); err != nil {
+			return err
+		}
+		delta = 0
+		if wasPublished && p.Draft {
+			delta = -1
+		} else if !wasPublished && !p.Draft {
+			delta = 1
+		}
+		return updatePublishedPostCount(c, p.Slug, delta)
+	}, &datastore.TransactionOptions{XG: true})
+
+	if err != nil {
+		panic(err)
+	}
+
+	invalidatePostCaches(c)
+}
+
+// invalidatePostCaches records that posts changed and drops all caches derived
+// from posts, i.e. the cached post count, the last updated time, the tag and
+// archive counts and the cached front page. Must be called after any change
+// to a post.
+func invalidatePostCaches(c context.Context) {
+	// Before the new generation starts, so that it cannot cache the old time.
+	touchPostsChanged(c)
+	generation := newCacheGeneration(c)
+	logging.Infof(c, "Started post cache generation %s", generation)
+}
+
+// postCacheKey returns the memcache key for a cache derived from posts. The
+// key includes the current cache generation, so that starting a new
+// generation invalidates all such caches at once. Callers must get the key
+// before loading the data they cache, so that data loaded before a change
+// never ends up in the new generation.
+func postCacheKey(c context.Context, key string) string {
+	return key + "@" + cacheGeneration(c)
+}
+
+// cacheGeneration returns the current generation of post caches, starting a
+// new one if it is unknown, e.g. because memcache evicted it.
+func cacheGeneration(c context.Context) string {
+	it, err := memcache.GetKey(c, cacheGenerationKey)
+	if err == nil {
+		return string(it.Value())
+	}
+	if err != memcache.ErrCacheMiss {
+		logging.Errorf(c, "Error trying to read cache generation: %s, proceeding.", err)
+	}
+	return newCacheGeneration(c)
+}
+
+// newCacheGeneration starts a new generation of post caches. Generations are
+// timestamps rather than an incremented number, so that a generation that got
+// evicted from memcache is never started again, which would revive stale
+// caches.
+func newCacheGeneration(c context.Context) string {
+	generation := strconv.FormatInt(time.Now().UnixNano(), 36)
+	it := memcache.NewItem(c, cacheGenerationKey)
+	it.SetValue([]byte(generation))
+	if err := memcache.Set(c, it); err != nil {
+		logging.Errorf(c, "Error trying to store cache generation: %s, proceeding.", err)
+	}
+	return generation
+}
+
+// trashPost moves a post to the trash, hiding it from everybody but admins.
+func trashPost(c context.Context, p *Post) {
+	p.Trashed = true
+	p.Scheduled = false
+	p.Updated = time.Now().UTC()
+	storePost(c, p)
+}
+
+// publishDuePosts publishes all scheduled posts whose publication time is
+// before now. Returns the number of published posts.
+func publishDuePosts(c context.Context, now time.Time) int {
+	keys := make([]*datastore.Key, 0)
+	q := datastore.NewQuery(PostEntity).
+		Eq("scheduled", true).
+		Lte("publishAt", now).
+		KeysOnly(true)
+	if err := datastore.GetAll(c, q, &keys); err != nil {
+		panic(err)
+	}
+
+	published := 0
+	for _, key := range keys {
+		p := &Post{Slug: key}
+		var due bool
+		err := datastore.RunInTransaction(c, func(c context.Context) error {
+			if err := datastore.Get(c, p); err != nil {
+				return err
+			}
+			// The post might have been edited since the query ran.
+			due = p.Scheduled && !p.PublishAt.After(now)
+			if !due {
+				return nil
+			}
+			p.Scheduled = false
+			p.Draft = false
+			// Sort the post by when it was published, not when it was written.
+			p.Created = p.PublishAt
+			p.Updated = now
+			if err := datastore.Put(c, p, newRevision(c, p)); err != nil {
+				return err
+			}
+			return updatePublishedPostCount(c, p.Slug, 1)
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil {
+			panic(err)
+		}
+		if due {
+			logging.Infof(c, "Published scheduled post %s", key)
+			published++
+		}
+	}
+	if published > 0 {
+		invalidatePostCaches(c)
+	}
+	return published
+}
+
+// restorePost takes a post out of the trash. It is restored as a draft.
+func restorePost(c context.Context, p *Post) {
+	p.Trashed = false
+	p.Draft = true
+	p.Updated = time.Now().UTC()
+	storePost(c, p)
+}
+
+// purgePost permanently deletes a trashed post along with its comments and
+// all other entities stored below it.
+func purgePost(c context.Context, p *Post) {
+	if !p.Trashed {
+		panic(fmt.Errorf("refusing to purge post %s that is not in the trash", p.Slug))
+	}
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		// Kindless ancestor queries include the post itself.
+		keys := make([]*datastore.Key, 0, p.NumComments+1)
+		q := datastore.NewQuery("").Ancestor(p.Slug).KeysOnly(true)
+		if err := datastore.GetAll(c, q, &keys); err != nil {
+			return err
+		}
+		logging.Infof(c, "Purging %s: %s", p.Slug, keys)
+		return datastore.Delete(c, keys)
+	}, nil)
+	if err != nil {
+		panic(err)
+	}
+	invalidatePostCaches(c)
+}
+
+// loadTrashedPosts loads all posts in the trash, most recently trashed first.
+func loadTrashedPosts(c context.Context) []Post {
+	posts := make([]Post, 0)
+	q := datastore.NewQuery(PostEntity).
+		Eq("trashed", true).
+		Order("-updated")
+	if err := datastore.GetAll(c, q, &posts); err != nil {
+		panic(err)
+	}
+	return posts
+}
+
+// renamePost moves the post, its comments and its revisions to a new slug, and
+// records a redirect from the old slug. The post is stored as passed in.
+func renamePost(c context.Context, p *Post, slugString string) {
+	oldSlug := p.Slug
+	newSlug := createSlug(c, slugString)
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		ex, err := datastore.Exists(c, newSlug)
+		if err != nil {
+			return err
+		}
+		if ex.Get(0) {
+			return fmt.Errorf("cannot rename %s, a post with slug %s exists", oldSlug, newSlug)
+		}
+
+		comments := make([]Comment, 0, p.NumComments)
+		if err := datastore.GetAll(c, datastore.NewQuery(CommentEntity).Ancestor(oldSlug), &comments); err != nil {
+			return err
+		}
+		revisions := make([]Revision, 0)
+		if err := datastore.GetAll(c, datastore.NewQuery(RevisionEntity).Ancestor(oldSlug), &revisions); err != nil {
+			return err
+		}
+		// Preview links are signed for the old slug, so they are dropped.
+		oldKeys := make([]*datastore.Key, 0)
+		q := datastore.NewQuery(PreviewTokenEntity).Ancestor(oldSlug).KeysOnly(true)
+		if err := datastore.GetAll(c, q, &oldKeys); err != nil {
+			return err
+		}
+		oldKeys = append(oldKeys, oldSlug)
+		for i := range comments {
+			oldKeys = append(oldKeys, comments[i].Key)
+			comments[i].Key = datastore.NewKey(c, CommentEntity, "", comments[i].Key.IntID(), newSlug)
+		}
+		for i := range revisions {
+			oldKeys = append(oldKeys, revisions[i].Key)
+			revisions[i].Key = datastore.NewKey(c, RevisionEntity, "", revisions[i].Key.IntID(), newSlug)
+		}
+
+		p.Slug = newSlug
+		redirect := &SlugRedirect{
+			Slug:   datastore.NewKey(c, SlugRedirectEntity, oldSlug.StringID(), 0, nil),
+			Target: newSlug,
+		}
+		if err := datastore.Put(c, p, comments, revisions, redirect); err != nil {
+			return err
+		}
+		if err := datastore.Delete(c, oldKeys); err != nil {
+			return err
+		}
+		// Renaming back to an earlier slug makes its redirect obsolete.
+		return datastore.Delete(c, datastore.NewKey(c, SlugRedirectEntity, slugString, 0, nil))
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		p.Slug = oldSlug
+		panic(err)
+	}
+	logging.Infof(c, "Renamed post %s to %s", oldSlug, newSlug)
+	invalidatePostCaches(c)
+}
+
+func configKey(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, ConfigEntity, "config", 0, nil)
+}
+
+// loadConfig loads the blog's configuration, creating it on first use.
+func loadConfig(c context.Context) *Config {
+	config := &Config{Key: configKey(c)}
+	err := datastore.Get(c, config)
+	if err == nil {
+		return config
+	} else if err != datastore.ErrNoSuchEntity {
+		panic(err)
+	}
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		err := datastore.Get(c, config)
+		if err != datastore.ErrNoSuchEntity {
+			return err // Created concurrently, or failed.
+		}
+		config.PreviewSecret = make([]byte, 32)
+		if _, err := rand.Read(config.PreviewSecret); err != nil {
+			return err
+		}
+		return datastore.Put(c, config)
+	}, nil)
+	if err != nil {
+		panic(err)
+	}
+	return config
+}
+
+// tagAuthorityRE matches the "authority,date" part of tag URIs, where the
+// authority is a domain name or an email address.
+var tagAuthorityRE = regexp.MustCompile(
+	`^([a-z0-9_.+-]+@)?[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*,\d{4}(-\d{2}(-\d{2})?)?$`)
+
+// firstPostDate returns when the oldest published post was created, or now if
+// there are none.
+func firstPostDate(c context.Context) time.Time {
+	posts := make([]Post, 0, 1)
+	q := datastore.NewQuery(PostEntity).Eq("draft", false).Order("created").Limit(1)
+	if err := datastore.GetAll(c, q, &posts); err != nil {
+		panic(err)
+	}
+	if len(posts) == 0 {
+		return time.Now()
+	}
+	return posts[0].Created
+}
+
+// defaultTagAuthority returns the tag URI authority for the host, dated with
+// the first post, so that configuring the host keeps the IDs used before.
+func defaultTagAuthority(c context.Context, host string) string {
+	return strings.ToLower(host) + "," + firstPostDate(c).UTC().Format("2006-01-02")
+}
+
+// initTagAuthority sets the config's tag URI authority, unless it has been set
+// before.
+func initTagAuthority(c context.Context, config *Config, authority string) {
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		if err := datastore.Get(c, config); err != nil {
+			return err
+		}
+		if config.TagAuthority != "" {
+			return nil // Set concurrently.
+		}
+		config.TagAuthority = authority
+		return datastore.Put(c, config)
+	}, nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newAppPassword replaces the app password with a new random one, which is
+// returned. Only its hash is stored.
+func newAppPassword(c context.Context, config *Config) string {
+	secret := make([]byte, 24)
+	config.AppPasswordSalt = make([]byte, 16)
+	for _, b := range [][]byte{secret, config.AppPasswordSalt} {
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+	}
+	password := base64.RawURLEncoding.EncodeToString(secret)
+	config.AppPasswordHash = hashAppPassword(config.AppPasswordSalt, password)
+	storeConfig(c, config)
+	return password
+}
+
+// revokeAppPassword removes the app password, so that no API client can
+// authenticate.
+func revokeAppPassword(c context.Context, config *Config) {
+	config.AppPasswordSalt = nil
+	config.AppPasswordHash = nil
+	storeConfig(c, config)
+}
+
+// App passwords are long random strings, so a plain hash is hard enough to
+// reverse.
+func hashAppPassword(salt []byte, password string) []byte {
+	hash := sha256.New()
+	hash.Write(salt)
+	hash.Write([]byte(password))
+	return hash.Sum(nil)
+}
+
+// checkAppPassword returns whether password is the app password.
+func checkAppPassword(config *Config, password string) bool {
+	if len(config.AppPasswordHash) == 0 {
+		return false
+	}
+	return hmac.Equal(hashAppPassword(config.AppPasswordSalt, password), config.AppPasswordHash)
+}
+
+// formToken returns the token that the admin's forms send along in a
+// browser session, identified by a random nonce. Sites that post forms
+// cross-site cannot know it, as it is signed for the signed in user.
+func formToken(c context.Context, nonce string) string {
+	email := ""
+	if u := user.Current(c); u != nil {
+		email = u.Email
+	}
+	mac := hmac.New(sha256.New, formSecret(c))
+	fmt.Fprintf(mac, "%s\n%s", email, nonce)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// formSecret returns the secret that form tokens are signed with, creating it
+// on first use.
+func formSecret(c context.Context) []byte {
+	config := loadConfig(c)
+	if len(config.FormSecret) > 0 {
+		return config.FormSecret
+	}
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		if err := datastore.Get(c, config); err != nil {
+			return err
+		}
+		if len(config.FormSecret) > 0 {
+			return nil // Created concurrently.
+		}
+		config.FormSecret = make([]byte, 32)
+		if _, err := rand.Read(config.FormSecret); err != nil {
+			return err
+		}
+		return datastore.Put(c, config)
+	}, nil)
+	if err != nil {
+		panic(err)
+	}
+	return config.FormSecret
+}
+
+type appPasswordKey struct{}
+
+// withAppPassword marks requests authenticated with the app password, which
+// may do anything an admin may do.
+func withAppPassword(c context.Context) context.Context {
+	return context.WithValue(c, appPasswordKey{}, true)
+}
+
+// isAdmin returns whether the request is by an admin, either signed in or
+// authenticated with the app password.
+func isAdmin(c context.Context) bool {
+	return c.Value(appPasswordKey{}) != nil || user.IsAdmin(c)
+}
+
+// storeMedia stores an uploaded file under a name derived from the given one,
+// which is made unique by appending a number if needed.
+func storeMedia(c context.Context, name, contentType string, data []byte) *Media {
+	if len(data) > maxMediaSize {
+		panic(fmt.Errorf("%s is too large, %d > %d bytes", name, len(data), maxMediaSize))
+	}
+	ext := strings.ToLower(path.Ext(name))
+	if !mediaExtRE.MatchString(ext) {
+		ext = ""
+	}
+	base := titleToSlug(strings.TrimSuffix(path.Base(name), path.Ext(name)))
+	m := &Media{ContentType: contentType, Data: data, Created: time.Now().UTC()}
+	for i := 0; ; i++ {
+		candidate := base + ext
+		if i > 0 {
+			candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		m.Key = datastore.NewKey(c, MediaEntity, candidate, 0, nil)
+		// Each candidate is its own entity group, so each is claimed in its
+		// own transaction.
+		claimed := false
+		err := datastore.RunInTransaction(c, func(c context.Context) error {
+			ex, err := datastore.Exists(c, m.Key)
+			if err != nil {
+				return err
+			}
+			if claimed = !ex.Get(0); claimed {
+				return datastore.Put(c, m)
+			}
+			return nil
+		}, nil)
+		if err != nil {
+			panic(err)
+		}
+		if claimed {
+			return m
+		}
+	}
+}
+
+func loadMedia(c context.Context, name string) *Media {
+	m := &Media{Key: datastore.NewKey(c, MediaEntity, name, 0, nil)}
+	if err := datastore.Get(c, m); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// storeConfig stores changed settings.
+func storeConfig(c context.Context, config *Config) {
+	if err := datastore.Put(c, config); err != nil {
+		panic(err)
+	}
+}
+
+// signPreview returns the signature of a preview token for the post with the
+// given slug.
+func signPreview(config *Config, slug *datastore.Key, id int64, expires time.Time) string {
+	mac := hmac.New(sha256.New, config.PreviewSecret)
+	fmt.Fprintf(mac, "%s\n%d\n%d", slug.StringID(), id, expires.Unix())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func previewLink(c context.Context, config *Config, p *Post, t *PreviewToken) PreviewLink {
+	token := fmt.Sprintf("%d.%d.%s", t.Key.IntID(), t.Expires.Unix(),
+		signPreview(config, p.Slug, t.Key.IntID(), t.Expires))
+	u, err := routePreview.URL(
+		"ymd", p.Created.Format("2006/01/02"),
+		"slug", p.Slug.StringID(),
+		"token", token)
+	if err != nil {
+		panic(err)
+	}
+	return PreviewLink{*t, template.URL(u.String())}
+}
+
+// createPreviewLink mints a preview link for the post that is valid for the
+// given duration.
+func createPreviewLink(c context.Context, p *Post, validFor time.Duration) PreviewLink {
+	now := time.Now().UTC()
+	t := &PreviewToken{
+		Key:     datastore.NewKey(c, PreviewTokenEntity, "", 0, p.Slug),
+		Expires: now.Add(validFor).Truncate(time.Second),
+		Created: now,
+	}
+	if u := user.Current(c); u != nil {
+		t.Creator = u.Email
+	}
+	if err := datastore.Put(c, t); err != nil {
+		panic(err)
+	}
+	return previewLink(c, loadConfig(c), p, t)
+}
+
+// loadPreviewLinks loads the active preview links of a post, soonest to expire
+// first. Expired tokens are deleted.
+func loadPreviewLinks(c context.Context, p *Post) []PreviewLink {
+	tokens := make([]PreviewToken, 0)
+	if err := datastore.GetAll(c, datastore.NewQuery(PreviewTokenEntity).Ancestor(p.Slug), &tokens); err != nil {
+		panic(err)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Expires.Before(tokens[j].Expires) })
+
+	config := loadConfig(c)
+	now := time.Now()
+	links := make([]PreviewLink, 0, len(tokens))
+	expired := make([]*datastore.Key, 0)
+	for i := range tokens {
+		if tokens[i].Expires.Before(now) {
+			expired = append(expired, tokens[i].Key)
+		} else {
+			links = append(links, previewLink(c, config, p, &tokens[i]))
+		}
+	}
+	if len(expired) > 0 {
+		// Ok to fail, they are ignored anyway.
+		if err := datastore.Delete(c, expired); err != nil {
+			logging.Warningf(c, "Failed to delete expired preview tokens: %s", err)
+		}
+	}
+	return links
+}
+
+// revokePreviewLink deletes a preview token, invalidating its link.
+func revokePreviewLink(c context.Context, p *Post, id int64) {
+	if err := datastore.Delete(c, datastore.NewKey(c, PreviewTokenEntity, "", id, p.Slug)); err != nil {
+		panic(err)
+	}
+}
+
+// loadPreviewPost loads a post by slug for a preview link, regardless of
+// whether it is a draft. Invalid, expired or revoked tokens 404.
+func loadPreviewPost(c context.Context, slugString, token string) *Post {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		panic(datastore.ErrNoSuchEntity)
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		panic(datastore.ErrNoSuchEntity)
+	}
+	expiresUnix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		panic(datastore.ErrNoSuchEntity)
+	}
+	expires := time.Unix(expiresUnix, 0)
+	slug := createSlug(c, slugString)
+	signature := signPreview(loadConfig(c), slug, id, expires)
+	if !hmac.Equal([]byte(signature), []byte(parts[2])) || expires.Before(time.Now()) {
+		panic(datastore.ErrNoSuchEntity)
+	}
+
+	// Revoked tokens no longer exist.
+	t := &PreviewToken{Key: datastore.NewKey(c, PreviewTokenEntity, "", id, slug)}
+	if err := datastore.Get(c, t); err != nil {
+		panic(err)
+	}
+	p := &Post{Slug: slug}
+	if err := datastore.Get(c, p); err != nil {
+		panic(err)
+	}
+	if p.Trashed {
+		panic(datastore.ErrNoSuchEntity)
+	}
+	return p
+}
+
+// postExists returns whether there is a post with the given slug, including
+// drafts and trashed posts.
+func postExists(c context.Context, slugString string) bool {
+	ex, err := datastore.Exists(c, createSlug(c, slugString))
+	if err != nil {
+		panic(err)
+	}
+	return ex.Get(0)
+}
+
+// maxSlugRedirects bounds the chain of renames followed to find a post.
+const maxSlugRedirects = 10
+
+// loadRedirectedPost returns the post that used to have the given slug, or nil
+// if the slug was never renamed.
+func loadRedirectedPost(c context.Context, slugString string) *Post {
+	redirect := &SlugRedirect{Slug: datastore.NewKey(c, SlugRedirectEntity, slugString, 0, nil)}
+	for i := 0; i < maxSlugRedirects; i++ {
+		err := datastore.Get(c, redirect)
+		if err == datastore.ErrNoSuchEntity {
+			break
+		} else if err != nil {
+			panic(err)
+		}
+		p := &Post{Slug: redirect.Target}
+		if err := datastore.Get(c, p); err == nil {
+			return p
+		} else if err != datastore.ErrNoSuchEntity {
+			panic(err)
+		}
+		// The post was renamed again, or purged.
+		redirect = &SlugRedirect{Slug: datastore.NewKey(c, SlugRedirectEntity, redirect.Target.StringID(), 0, nil)}
+	}
+	return nil
+}
+
+func newRevision(c context.Context, p *Post) *Revision {
+	rev := &Revision{
+		Key:     datastore.NewKey(c, RevisionEntity, "", 0, p.Slug),
+		Title:   p.Title,
+		Text:    p.Text,
+		Draft:   p.Draft,
+		Created: time.Now().UTC(),
+	}
+	if u := user.Current(c); u != nil {
+		rev.Editor = u.Email
+	}
+	return rev
+}
+
+// loadRevisions loads all revisions of a post, newest first.
+func loadRevisions(c context.Context, p *Post) []Revision {
+	revisions := make([]Revision, 0)
+	q := datastore.NewQuery(RevisionEntity).
+		Ancestor(p.Slug).
+		Order("-created")
+	if err := datastore.GetAll(c, q, &revisions); err != nil {
+		panic(err)
+	}
+	return revisions
+}
+
+func loadRevision(c context.Context, p *Post, id int64) *Revision {
+	rev := &Revision{Key: datastore.NewKey(c, RevisionEntity, "", id, p.Slug)}
+	if err := datastore.Get(c, rev); err != nil {
+		panic(err)
+	}
+	return rev
+}
+
+// restoreRevision reverts the post's content to the given revision. This is
+// stored as a new revision itself, so it can be undone.
+func restoreRevision(c context.Context, p *Post, rev *Revision) {
+	p.Title = rev.Title
+	p.Text = rev.Text
+	p.Draft = rev.Draft
+	p.Updated = time.Now().UTC()
+	storePost(c, p)
+}
+
+func storeComment(c context.Context, p *Post, comment *Comment) error {
+	newComment := comment.Key == nil
+	if p.Slug == nil {
+		return fmt.Errorf("Cannot store comment on new post")
+	}
+	comment.render()
 
 	if newComment {
 		comment.Key = datastore.NewKey(c, CommentEntity, "", 0, p.Slug)
-		p.NumComments++
-		return datastore.RunInTransaction(c, func(c context.Context) error {
+		if comment.Approved {
+			p.NumComments++
+			p.CommentsUpdated = time.Now().UTC()
+		}
+		err := datastore.RunInTransaction(c, func(c context.Context) error {
 			if err := datastore.Put(c, p); err != nil {
 				return err
 			}
@@ -269,28 +1771,455 @@ func storeComment(c context.Context, p *Post, comment *Comment) error {
 			}
 			return nil
 		}, &datastore.TransactionOptions{XG: true})
+		if err == nil && comment.Approved {
+			// Listings show the number of comments.
+			invalidatePostCaches(c)
+		}
+		return err
 	}
 
 	return datastore.Put(c, comment)
 }
 
+// loadWebmention loads the webmention of the post sent by the given source,
+// or returns nil if there is none.
+func loadWebmention(c context.Context, p *Post, source string) (*Comment, error) {
+	var comments []Comment
+	q := datastore.NewQuery(CommentEntity).Ancestor(p.Slug).Eq("source", source).Limit(1)
+	if err := datastore.GetAll(c, q, &comments); err != nil {
+		return nil, err
+	}
+	if len(comments) == 0 {
+		return nil, nil
+	}
+	return &comments[0], nil
+}
+
+// storeWebmention stores a verified webmention of the post, replacing an
+// earlier one from the same source. The earlier mention's moderation state
+// carries over. Looking the mention up in the same transaction keeps
+// verifications of the same source that run concurrently from storing it
+// twice.
+func storeWebmention(c context.Context, p *Post, mention *Comment) error {
+	if p.Slug == nil {
+		return fmt.Errorf("Cannot store webmention on new post")
+	}
+	mention.render()
+	now := time.Now().UTC()
+	return datastore.RunInTransaction(c, func(c context.Context) error {
+		existing, err := loadWebmention(c, p, mention.Source)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			mention.Key = existing.Key
+			mention.Approved, mention.Rejected = existing.Approved, existing.Rejected
+			mention.Created = existing.Created
+		} else {
+			// Mentions await moderation, so the post's comment count stays.
+			mention.Key = datastore.NewKey(c, CommentEntity, "", 0, p.Slug)
+			mention.Approved, mention.Rejected = false, false
+			mention.Created = now
+		}
+		mention.Updated = now
+		return datastore.Put(c, mention)
+	}, nil)
+}
+
+// commentMigrationBatchSize is the number of comments migrateComments
+// re-stores at a time.
+const commentMigrationBatchSize = 100
+
+// migrateComments stores all comments again, so that comments stored before
+// moderation existed get indexed approved and rejected properties. Until it
+// has run, queries on these properties miss the old comments.
+func migrateComments(c context.Context) int {
+	var keys []*datastore.Key
+	if err := datastore.GetAll(c, datastore.NewQuery(CommentEntity).KeysOnly(true), &keys); err != nil {
+		panic(err)
+	}
+	for start := 0; start < len(keys); start += commentMigrationBatchSize {
+		end := start + commentMigrationBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		comments := make([]Comment, end-start)
+		for i, key := range keys[start:end] {
+			comments[i].Key = key
+		}
+		// Missing rejected properties load as false, approved ones are kept.
+		if err := datastore.Get(c, comments); err != nil {
+			panic(err)
+		}
+		if err := datastore.Put(c, comments); err != nil {
+			panic(err)
+		}
+	}
+
+	config := loadConfig(c)
+	config.CommentsMigrated = true
+	storeConfig(c, config)
+	invalidatePostCaches(c)
+	return len(keys)
+}
+
+// rerenderPosts stores the HTML of posts and comments that were rendered with
+// an outdated markdown configuration. Returns the number of posts and
+// comments rendered.
+func rerenderPosts(c context.Context) int {
+	var keys []*datastore.Key
+	if err := datastore.GetAll(c, datastore.NewQuery(PostEntity).KeysOnly(true), &keys); err != nil {
+		panic(err)
+	}
+	rendered := 0
+	for _, key := range keys {
+		// A post and its comments form an entity group, so they are rendered
+		// in one transaction, which doesn't overwrite concurrent edits.
+		var n int
+		err := datastore.RunInTransaction(c, func(c context.Context) error {
+			n = 0
+			p := &Post{Slug: key}
+			if err := datastore.Get(c, p); err != nil {
+				return err
+			}
+			var comments, stale []Comment
+			if err := datastore.GetAll(c, datastore.NewQuery(CommentEntity).Ancestor(key), &comments); err != nil {
+				return err
+			}
+			for _, comment := range comments {
+				if comment.RenderVersion != markdownVersion {
+					comment.render()
+					stale = append(stale, comment)
+				}
+			}
+			if len(stale) > 0 {
+				if err := datastore.Put(c, stale); err != nil {
+					return err
+				}
+				n += len(stale)
+			}
+			if p.RenderVersion == markdownVersion {
+				return nil
+			}
+			p.render()
+			n++
+			return datastore.Put(c, p)
+		}, nil)
+		if err != nil {
+			panic(err)
+		}
+		rendered += n
+	}
+
+	config := loadConfig(c)
+	config.RenderVersion = markdownVersion
+	storeConfig(c, config)
+	return rendered
+}
+
+// migratePosts stores all posts again, so that posts stored before the trash
+// existed get an indexed trashed property. Until it has run, admins' queries
+// cannot filter the trash.
+func migratePosts(c context.Context) int {
+	var keys []*datastore.Key
+	if err := datastore.GetAll(c, datastore.NewQuery(PostEntity).KeysOnly(true), &keys); err != nil {
+		panic(err)
+	}
+	for _, key := range keys {
+		// Posts are entity groups of their own, each is stored in a
+		// transaction so that concurrent edits are kept.
+		err := datastore.RunInTransaction(c, func(c context.Context) error {
+			p := &Post{Slug: key}
+			if err := datastore.Get(c, p); err != nil {
+				return err
+			}
+			return datastore.Put(c, p)
+		}, nil)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	config := loadConfig(c)
+	config.PostsMigrated = true
+	storeConfig(c, config)
+	return len(keys)
+}
+
+func pendingCommentsQuery() *datastore.Query {
+	return datastore.NewQuery(CommentEntity).
+		Eq("approved", false).
+		Eq("rejected", false)
+}
+
+// loadPendingComments loads the given page (1-based) of comments awaiting
+// moderation across all posts, newest first.
+func loadPendingComments(c context.Context, page int) []PendingComment {
+	comments := make([]Comment, 0, commentsPerPage)
+	q := pendingCommentsQuery().
+		Order("-created").
+		Offset(int32((page - 1) * commentsPerPage)).
+		Limit(commentsPerPage)
+	if err := datastore.GetAll(c, q, &comments); err != nil {
+		panic(err)
+	}
+
+	return withPosts(c, comments)
+}
+
+// withPosts loads the posts the comments were made on.
+func withPosts(c context.Context, comments []Comment) []PendingComment {
+	posts := make([]Post, len(comments))
+	for i, comment := range comments {
+		posts[i].Slug = comment.Key.Parent()
+	}
+	if err := datastore.Get(c, posts); err != nil {
+		panic(err)
+	}
+
+	result := make([]PendingComment, len(comments))
+	for i := range comments {
+		result[i] = PendingComment{Comment: comments[i], Post: &posts[i]}
+	}
+	return result
+}
+
+// loadCommentsPage loads a page of approved comments, newest first, on the
+// given post or on all published posts if p is nil. Pages are selected by
+// cursors on the comments' creation time, just like pages of posts.
+func loadCommentsPage(c context.Context, p *Post, cur pageCursor) (comments []PendingComment, newer, older *pageCursor) {
+	q := datastore.NewQuery(CommentEntity).Eq("approved", true)
+	if p != nil {
+		q = q.Ancestor(p.Slug)
+	}
+	query := func(q *datastore.Query) []Comment {
+		result := make([]Comment, 0, commentsPerPage+1)
+		if err := datastore.GetAll(c, q.Limit(commentsPerPage+1), &result); err != nil {
+			panic(err)
+		}
+		return result
+	}
+
+	var page []Comment
+	if !cur.After.IsZero() {
+		page = query(q.Gt("created", cur.After).Order("created"))
+		if len(page) <= commentsPerPage {
+			// Reached the newest comments, fill the page up with older ones.
+			return loadCommentsPage(c, p, pageCursor{})
+		}
+		page = page[:commentsPerPage]
+		for i, j := 0, len(page)-1; i < j; i, j = i+1, j-1 {
+			page[i], page[j] = page[j], page[i]
+		}
+		newer = &pageCursor{After: page[0].Created}
+		older = &pageCursor{Before: page[len(page)-1].Created}
+	} else {
+		q = q.Order("-created")
+		if !cur.Before.IsZero() {
+			q = q.Lt("created", cur.Before)
+		}
+		page = query(q)
+		if len(page) > commentsPerPage {
+			page = page[:commentsPerPage]
+			older = &pageCursor{Before: page[len(page)-1].Created}
+		}
+		if !cur.isZero() && len(page) > 0 {
+			newer = &pageCursor{After: page[0].Created}
+		}
+	}
+
+	comments = withPosts(c, page)
+	if p == nil {
+		// Comments on posts that were unpublished since are not shown. This
+		// makes some pages shorter, but keeps the cursors simple.
+		visible := comments[:0]
+		for _, comment := range comments {
+			if !comment.Post.Draft {
+				visible = append(visible, comment)
+			}
+		}
+		comments = visible
+	}
+	return comments, newer, older
+}
+
+// getPendingCommentPageCount counts the pages of comments awaiting moderation.
+func getPendingCommentPageCount(c context.Context) int {
+	count, err := datastore.Count(c, pendingCommentsQuery())
+	if err != nil {
+		panic(err)
+	}
+	if count == 0 {
+		return 1
+	}
+	return int((count + commentsPerPage - 1) / commentsPerPage)
+}
+
+// Moderation actions on comments.
+const (
+	moderationApprove = "approve"
+	moderationReject  = "reject"
+	moderationDelete  = "delete"
+)
+
+// moderateComment approves, rejects or deletes the comment with the given
+// key, keeping the post's NumComments in sync with its approved comments.
+func moderateComment(c context.Context, key *datastore.Key, action string) error {
+	if key.Kind() != CommentEntity || key.Parent() == nil {
+		return fmt.Errorf("not a comment key: %s", key)
+	}
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		comment := &Comment{Key: key}
+		p := &Post{Slug: key.Parent()}
+		if err := datastore.Get(c, comment, p); err != nil {
+			return err
+		}
+
+		wasApproved := comment.Approved
+		switch action {
+		case moderationApprove:
+			comment.Approved, comment.Rejected = true, false
+		case moderationReject:
+			comment.Approved, comment.Rejected = false, true
+		case moderationDelete:
+			comment.Approved = false
+		default:
+			return fmt.Errorf("unknown moderation action %q", action)
+		}
+		if wasApproved && !comment.Approved {
+			p.NumComments--
+		} else if !wasApproved && comment.Approved {
+			p.NumComments++
+		}
+		// Admins see moderation changes of any comment.
+		p.CommentsUpdated = time.Now().UTC()
+
+		if action == moderationDelete {
+			if err := datastore.Delete(c, key); err != nil {
+				return err
+			}
+		} else {
+			comment.Updated = time.Now().UTC()
+			if err := datastore.Put(c, comment); err != nil {
+				return err
+			}
+		}
+		return datastore.Put(c, p)
+	}, nil)
+	if err == nil {
+		invalidatePostCaches(c)
+	}
+	return err
+}
+
 var (
 	slugRE   = regexp.MustCompile("[^-A-Za-z0-9_]")
 	dashesRE = regexp.MustCompile("-{2,}")
+	// Extensions of media file names.
+	mediaExtRE = regexp.MustCompile(`^\.[a-z0-9]+$`)
 )
 
 func titleToSlug(title string) string {
-	slug := title
+	slug := transliterate(title)
 	slug = strings.Replace(slug, " ", "-", -1)
 	slug = slugRE.ReplaceAllLiteralString(slug, "")
 	slug = dashesRE.ReplaceAllLiteralString(slug, "-")
-	return strings.ToLower(slug)
+	slug = strings.Trim(slug, "-")
+	if slug == "" && strings.TrimSpace(title) == "" {
+		slug = "untitled"
+	} else if slug == "" {
+		// Nothing could be transliterated, e.g. for CJK titles. Fall back to a
+		// hash, so that the same title still gives the same slug.
+		h := fnv.New32a()
+		h.Write([]byte(title))
+		slug = fmt.Sprintf("%08x", h.Sum32())
+	}
+	return slug
 }
 
-func slugify(c context.Context, p *Post) *datastore.Key {
+// slugHint normalizes a slug requested by an author. It is empty if none was
+// requested.
+func slugHint(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return ""
+	}
+	return titleToSlug(strings.TrimSpace(s))
+}
+
+// parseTags parses a comma separated list of tags, normalizing them so that
+// they can be used in URLs.
+func parseTags(s string) []string {
+	tags := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(s, ",") {
+		tag = slugHint(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+// loadTagCounts counts the published posts for each tag, sorted by tag.
+func loadTagCounts(c context.Context) []TagCount {
+	var tagCounts []TagCount
+	cacheKey := postCacheKey(c, tagCountsCacheKey)
+	err := memcacheGet(c, cacheKey, &tagCounts)
+	if err == nil {
+		return tagCounts
+	}
+	if err != memcache.ErrCacheMiss {
+		logging.Errorf(c, "Error trying to read tag counts: %s, proceeding.", err)
+	}
+
+	// Projecting a multi-valued property yields one result per value.
+	q := datastore.NewQuery(PostEntity).
+		Eq("draft", false).
+		Project("tags")
+	projected := make([]Post, 0)
+	if err := datastore.GetAll(c, q, &projected); err != nil {
+		panic(err)
+	}
+	counts := make(map[string]int)
+	for _, p := range projected {
+		for _, tag := range p.Tags {
+			counts[tag]++
+		}
+	}
+
+	tagCounts = make([]TagCount, 0, len(counts))
+	for tag, count := range counts {
+		tagCounts = append(tagCounts, TagCount{tag, count})
+	}
+	sort.Slice(tagCounts, func(i, j int) bool {
+		return tagCounts[i].Tag < tagCounts[j].Tag
+	})
+	// Ok to fail.
+	memcacheSet(c, cacheKey, tagCounts, 1*time.Hour)
+	return tagCounts
+}
+
+func slugify(c context.Context, p *Post, requested string) *datastore.Key {
 	if p.Slug != nil {
 		return p.Slug
 	}
+	if requested != "" {
+		key := createSlug(c, requested)
+		ex, err := datastore.Exists(c, key)
+		if err != nil {
+			panic(err)
+		}
+		if !ex.Get(0) {
+			return key
+		}
+	}
 	slug := titleToSlug(p.Title)
 	newSlug := slug
 	var lastErr error
@@ -2,6 +2,8 @@ package blog
 
 import (
 	"fmt"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -25,6 +27,12 @@ func setUpTestingDatastore(ctx context.Context) {
 	t := datastore.GetTestable(ctx)
 	t.Consistent(true)
 	t.AddIndexes(indices...)
+	// Tests start out with comments and posts indexed for moderation and the
+	// trash.
+	config := loadConfig(ctx)
+	config.CommentsMigrated = true
+	config.PostsMigrated = true
+	storeConfig(ctx, config)
 }
 
 func (m *ModelsTest) SetUpTest(c *C) {
@@ -45,20 +53,202 @@ func (m *ModelsTest) TestSlugCreation(c *C) {
 	c.Check(titleToSlug("Hello World     123 -- omg"), Equals, "hello-world-123-omg")
 }
 
+func (m *ModelsTest) TestSlugTransliteration(c *C) {
+	for _, t := range []struct{ title, slug string }{
+		{"Über Größe", "ueber-groesse"},
+		{"ÄRGER", "aerger"},
+		{"Café crème à la carte", "cafe-creme-a-la-carte"},
+		{"Łódź, Kraków & Gdańsk", "lodz-krakow-gdansk"},
+		{"Ærøskøbing œuvre", "aeroskobing-oeuvre"},
+		{"ﬁne ﬂow", "fine-flow"},
+		{"Привет, мир", "privet-mir"},
+		{"Щука и ёж", "shchuka-i-ezh"},
+		{"Καλημέρα κόσμε", "kalimera-kosme"},
+		{"Before – after", "before-after"},
+		{"Cafe\u0301 decomposed", "cafe-decomposed"},
+		{"U\u0308ber decomposed", "ueber-decomposed"},
+		// Accented letters that are not in the table.
+		{"Việt Nam", "viet-nam"},
+		{"Ǹ Ǹ", "n-n"},
+		{"Ångström Ǿ Ḟ", "angstroem-o-f"},
+		{"Şi ţară ǧ", "si-tara-g"},
+		{"  Hello!  ", "hello"},
+		{"", "untitled"},
+		{"   ", "untitled"},
+	} {
+		c.Check(titleToSlug(t.title), Equals, t.slug, Commentf("title %q", t.title))
+	}
+
+	// Titles without any transliterable characters get a stable hash.
+	cjk := titleToSlug("你好世界")
+	c.Check(cjk, Matches, "[0-9a-f]{8}")
+	c.Check(titleToSlug("你好世界"), Equals, cjk)
+	c.Check(titleToSlug("こんにちは"), Not(Equals), cjk)
+	c.Check(titleToSlug("你好 World"), Equals, "world")
+
+	// Blank slugs requested by authors mean there is no request.
+	c.Check(slugHint("  "), Equals, "")
+	c.Check(slugHint(" Hello World "), Equals, "hello-world")
+}
+
+func (m *ModelsTest) TestUntitledPostSlug(c *C) {
+	p := &Post{Title: "  "}
+	storePost(m.ctx, p)
+	c.Check(p.Slug.StringID(), Equals, "untitled")
+	other := &Post{}
+	storePost(m.ctx, other)
+	c.Check(other.Slug.StringID(), Equals, "untitled-1")
+}
+
 func (m *ModelsTest) TestPageCount(c *C) {
-	c.Check(getPageCount(m.ctx), Equals, 1)
-	c.Check(getPageCount(m.ctx), Equals, 1)
+	c.Check(getPageCount(m.ctx, allPosts), Equals, 1)
+	c.Check(getPageCount(m.ctx, allPosts), Equals, 1)
 
 	for i := 0; i < 11; i++ {
 		p := Post{Title: fmt.Sprintf("t%d", i)}
 		storePost(m.ctx, &p)
 	}
 
-	c.Check(getPageCount(m.ctx), Equals, 2)
+	c.Check(getPageCount(m.ctx, allPosts), Equals, 2)
+}
+
+func (m *ModelsTest) TestPublishedPostCount(c *C) {
+	// Posts stored before the counter is used are counted once.
+	posts := make([]*Post, 10)
+	for i := range posts {
+		posts[i] = &Post{Title: fmt.Sprintf("t%d", i)}
+		storePost(m.ctx, posts[i])
+	}
+	c.Check(loadPublishedPostCount(m.ctx), Equals, int64(10))
+	c.Check(getPageCount(m.ctx, allPosts), Equals, 1)
+
+	storePost(m.ctx, &Post{Title: "draft", Draft: true})
+	c.Check(loadPublishedPostCount(m.ctx), Equals, int64(10))
+	storePost(m.ctx, &Post{Title: "published"})
+	c.Check(getPageCount(m.ctx, allPosts), Equals, 2)
+
+	trashPost(m.ctx, posts[0])
+	posts[1].Draft = true
+	storePost(m.ctx, posts[1])
+	c.Check(loadPublishedPostCount(m.ctx), Equals, int64(9))
+	c.Check(getPageCount(m.ctx, allPosts), Equals, 1)
+
+	posts[1].Draft = false
+	storePost(m.ctx, posts[1])
+	posts[1].Text = "edited"
+	storePost(m.ctx, posts[1])
+	c.Check(loadPublishedPostCount(m.ctx), Equals, int64(10))
+
+	scheduled := &Post{Title: "scheduled", Scheduled: true, PublishAt: time.Now().Add(time.Hour)}
+	storePost(m.ctx, scheduled)
+	publishDuePosts(m.ctx, time.Now().Add(2*time.Hour))
+	c.Check(loadPublishedPostCount(m.ctx), Equals, int64(11))
+}
+
+func (m *ModelsTest) TestPublishedPostCount_Rebuild(c *C) {
+	// Changes before the counter is initialized are kept in the shards.
+	for i := 0; i < 3; i++ {
+		storePost(m.ctx, &Post{Title: fmt.Sprintf("t%d", i)})
+	}
+	sum, err := sumPublishedPostShards(m.ctx)
+	c.Assert(err, IsNil)
+	c.Check(sum, Equals, int64(3))
+	c.Check(loadPublishedPostCount(m.ctx), Equals, int64(3))
+	storePost(m.ctx, &Post{Title: "t3"})
+	c.Check(loadPublishedPostCount(m.ctx), Equals, int64(4))
+
+	// A miscounted base, e.g. from a stale count, is corrected by rebuilding.
+	c.Assert(datastore.Put(m.ctx, &CounterShard{Key: publishedPostsBaseKey(m.ctx), Count: 2}), IsNil)
+	c.Check(loadPublishedPostCount(m.ctx), Equals, int64(6))
+	c.Check(rebuildPublishedPostCount(m.ctx), Equals, int64(4))
+	c.Check(loadPublishedPostCount(m.ctx), Equals, int64(4))
+}
+
+func (m *ModelsTest) TestCacheInvalidation(c *C) {
+	p, _ := testPost()
+	storePost(m.ctx, p)
+	c.Check(newestPosts(m.ctx, allPosts)[0].Title, Equals, "Hello World")
+	lastUpdated := backdatePostsChanged(c, m.ctx)
+	c.Check(pageLastUpdated(m.ctx).Equal(lastUpdated), Equals, true)
+	generation := cacheGeneration(m.ctx)
+	c.Check(cacheGeneration(m.ctx), Equals, generation)
+
+	// Edits of existing posts show up in the cached listings.
+	p.Title = "Edited"
+	p.Updated = updated.Add(time.Hour)
+	storePost(m.ctx, p)
+	c.Check(cacheGeneration(m.ctx), Not(Equals), generation)
+	c.Check(newestPosts(m.ctx, allPosts)[0].Title, Equals, "Edited")
+	c.Check(pageLastUpdated(m.ctx).After(lastUpdated), Equals, true)
+
+	p.Draft = true
+	storePost(m.ctx, p)
+	c.Check(newestPosts(m.ctx, allPosts), HasLen, 0)
+	c.Check(getPageCount(m.ctx, allPosts), Equals, 1)
+}
+
+// newestPosts loads the first page of posts of the selection.
+func newestPosts(c context.Context, sel postSelection) []Post {
+	posts, _, _ := loadPosts(c, sel, pageCursor{})
+	return posts
+}
+
+func (m *ModelsTest) TestPageCursors(c *C) {
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 25; i++ {
+		storePost(m.ctx, &Post{
+			Title:      fmt.Sprintf("t%d", i),
+			Timestamps: Timestamps{Created: start.Add(time.Duration(i) * time.Hour)},
+		})
+	}
+	titles := func(posts []Post) string {
+		var ts []string
+		for _, p := range posts {
+			ts = append(ts, p.Title)
+		}
+		return strings.Join(ts, " ")
+	}
+
+	posts, newer, older := loadPosts(m.ctx, allPosts, pageCursor{})
+	c.Check(titles(posts), Equals, "t24 t23 t22 t21 t20 t19 t18 t17 t16 t15")
+	c.Check(newer, IsNil)
+	c.Assert(older, NotNil)
+
+	posts, newer, older = loadPosts(m.ctx, allPosts, *older)
+	c.Check(titles(posts), Equals, "t14 t13 t12 t11 t10 t9 t8 t7 t6 t5")
+	c.Assert(newer, NotNil)
+	second := *older
+
+	posts, _, older = loadPosts(m.ctx, allPosts, second)
+	c.Check(titles(posts), Equals, "t4 t3 t2 t1 t0")
+	c.Check(older, IsNil)
+
+	// Going back to newer posts, the first page is filled up.
+	posts, newer, _ = loadPosts(m.ctx, allPosts, *newer)
+	c.Check(titles(posts), Equals, "t24 t23 t22 t21 t20 t19 t18 t17 t16 t15")
+	c.Check(newer, IsNil)
+
+	posts, newer, older = loadPosts(m.ctx, allPosts, oldestPosts)
+	c.Check(titles(posts), Equals, "t9 t8 t7 t6 t5 t4 t3 t2 t1 t0")
+	c.Check(newer, NotNil)
+	c.Check(older, NotNil)
+
+	// The cursors survive URLs.
+	query, err := url.ParseQuery(second.queryString())
+	c.Assert(err, IsNil)
+	parsed, err := parsePageCursor(query)
+	c.Check(err, IsNil)
+	c.Check(parsed.Before.Equal(second.Before), Equals, true)
+	_, err = parsePageCursor(url.Values{"before": {"1"}, "after": {"2"}})
+	c.Check(err, NotNil)
+
+	c.Check(legacyPageCursor(m.ctx, allPosts, 1), Equals, pageCursor{})
+	c.Check(legacyPageCursor(m.ctx, allPosts, 3).Before.Equal(second.Before), Equals, true)
+	c.Check(func() { legacyPageCursor(m.ctx, allPosts, 4) }, PanicMatches, "datastore: no such entity")
 }
 
 func (m *ModelsTest) TestLoadStorePost(c *C) {
-	posts := loadPosts(m.ctx, 1)
+	posts := newestPosts(m.ctx, allPosts)
 	c.Check(len(posts), Equals, 0)
 
 	p, _ := testPost()
@@ -66,7 +256,7 @@ func (m *ModelsTest) TestLoadStorePost(c *C) {
 	c.Check(p.Slug, Not(IsNil))
 	c.Check(p.Slug.StringID(), Equals, "hello-world")
 
-	posts = loadPosts(m.ctx, 1)
+	posts = newestPosts(m.ctx, allPosts)
 	c.Check(len(posts), Equals, 1)
 	c.Check(posts[0].Slug, NotNil)
 
@@ -76,18 +266,98 @@ func (m *ModelsTest) TestLoadStorePost(c *C) {
 	c.Check(len(comments), Equals, 0)
 }
 
+func (m *ModelsTest) TestPageCursors_SameCreated(c *C) {
+	// Imported posts may share their creation time, also across pages.
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 25; i++ {
+		storePost(m.ctx, &Post{
+			Title:      fmt.Sprintf("t%02d", i),
+			Timestamps: Timestamps{Created: start.Add(time.Duration(i/4) * time.Hour)},
+		})
+	}
+	var want []string
+	for group := 6; group >= 0; group-- {
+		for i := group * 4; i < group*4+4 && i < 25; i++ {
+			want = append(want, fmt.Sprintf("t%02d", i))
+		}
+	}
+	titles := func(posts []Post) []string {
+		var ts []string
+		for _, p := range posts {
+			ts = append(ts, p.Title)
+		}
+		return ts
+	}
+
+	posts, _, older := loadPosts(m.ctx, allPosts, pageCursor{})
+	pages := [][]string{titles(posts)}
+	for older != nil {
+		posts, _, older = loadPosts(m.ctx, allPosts, *older)
+		pages = append(pages, titles(posts))
+	}
+	c.Assert(pages, HasLen, 3)
+	c.Check(append(append(pages[0], pages[1]...), pages[2]...), DeepEquals, want)
+
+	// Going back, the same pages come up.
+	posts, newer, _ := loadPosts(m.ctx, allPosts, *newerCursor(posts))
+	c.Check(titles(posts), DeepEquals, pages[1])
+	posts, _, _ = loadPosts(m.ctx, allPosts, *newer)
+	c.Check(titles(posts), DeepEquals, pages[0])
+}
+
+func (m *ModelsTest) TestPageCursors_Trash(c *C) {
+	admin := withAppPassword(m.ctx)
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	var stored []*Post
+	for i := 0; i < 13; i++ {
+		p := &Post{
+			Title:      fmt.Sprintf("t%d", i),
+			Timestamps: Timestamps{Created: start.Add(time.Duration(i) * time.Hour)},
+		}
+		storePost(m.ctx, p)
+		stored = append(stored, p)
+	}
+	trashPost(m.ctx, stored[12])
+	trashPost(m.ctx, stored[11])
+
+	// Admins get full pages without the trash.
+	posts, _, older := loadPosts(admin, allPosts, pageCursor{})
+	c.Check(posts, HasLen, postsPerPage)
+	c.Check(posts[0].Title, Equals, "t10")
+	c.Assert(older, NotNil)
+	posts, _, _ = loadPosts(admin, allPosts, *older)
+	c.Check(posts, HasLen, 1)
+}
+
 func (m *ModelsTest) TestPageLastUpdated(c *C) {
 	p, _ := testPost()
 	storePost(m.ctx, p)
-	lastUpdated := pageLastUpdated(m.ctx)
-	c.Check(lastUpdated, Equals, updated)
+	lastUpdated := backdatePostsChanged(c, m.ctx)
+	c.Check(pageLastUpdated(m.ctx).Equal(lastUpdated), Equals, true)
+
+	// Hiding posts changes the listings, too.
+	trashPost(m.ctx, p)
+	c.Check(pageLastUpdated(m.ctx).After(lastUpdated), Equals, true)
+	lastUpdated = backdatePostsChanged(c, m.ctx)
+	purgePost(m.ctx, p)
+	c.Check(pageLastUpdated(m.ctx).After(lastUpdated), Equals, true)
+}
+
+// backdatePostsChanged moves the time posts last changed an hour back, so
+// that later changes are distinguishable at the resolution of Last-Modified.
+func backdatePostsChanged(c *C, ctx context.Context) time.Time {
+	changed := &PostsChanged{Key: postsChangedKey(ctx), Time: time.Now().UTC().Add(-time.Hour).Truncate(time.Microsecond)}
+	c.Assert(datastore.Put(ctx, changed), IsNil)
+	newCacheGeneration(ctx)
+	return changed.Time
 }
 
 func (m *ModelsTest) TestPageLoadFixesCommentCount(c *C) {
 	p, comments := testPost()
 	comments = append(comments, Comment{
-		Author: "testAuthor3",
-		Text:   "textText3",
+		Author:   "testAuthor3",
+		Text:     "textText3",
+		Approved: true,
 	})
 	c.Check(p.NumComments, Equals, int32(2))
 	storePost(m.ctx, p)
@@ -101,6 +371,395 @@ func (m *ModelsTest) TestPageLoadFixesCommentCount(c *C) {
 	c.Check(len(comments), Equals, 3)
 }
 
+func (m *ModelsTest) TestLoadPostHidesUnapprovedComments(c *C) {
+	p, comments := testPost()
+	p.NumComments = 0
+	storePost(m.ctx, p)
+	comments[1].Approved = false
+	for i := range comments {
+		c.Assert(storeComment(m.ctx, p, &comments[i]), IsNil)
+	}
+
+	loaded, visible := loadPost(m.ctx, p.Slug.StringID())
+	c.Check(loaded.NumComments, Equals, int32(1))
+	c.Assert(visible, HasLen, 1)
+	c.Check(visible[0].Author, Equals, "testAuthor1")
+}
+
+// legacyComment is a comment as stored before moderation existed.
+type legacyComment struct {
+	Key      *datastore.Key `gae:"$key"`
+	Author   string         `gae:"author,noindex"`
+	Text     string         `gae:"text,noindex"`
+	Approved bool           `gae:"approved,noindex"`
+	Timestamps
+}
+
+func (m *ModelsTest) TestMigrateComments(c *C) {
+	config := loadConfig(m.ctx)
+	config.CommentsMigrated = false
+	storeConfig(m.ctx, config)
+
+	p, _ := testPost()
+	storePost(m.ctx, p)
+	for i, approved := range []bool{true, true, false} {
+		comment := &legacyComment{
+			Key:        datastore.NewKey(m.ctx, CommentEntity, "", 0, p.Slug),
+			Author:     fmt.Sprintf("Reader %d", i),
+			Text:       "Hi.",
+			Approved:   approved,
+			Timestamps: Timestamps{Created: created.Add(time.Duration(i) * time.Minute)},
+		}
+		c.Assert(datastore.Put(m.ctx, comment), IsNil)
+	}
+
+	// Unmigrated comments are shown, and the post's count is left alone.
+	loaded, comments := loadPost(m.ctx, p.Slug.StringID())
+	c.Check(comments, HasLen, 2)
+	c.Check(loaded.NumComments, Equals, int32(2))
+	c.Check(loadPendingComments(m.ctx, 1), HasLen, 0)
+
+	c.Check(migrateComments(m.ctx), Equals, 3)
+	c.Check(loadConfig(m.ctx).CommentsMigrated, Equals, true)
+	loaded, comments = loadPost(m.ctx, p.Slug.StringID())
+	c.Check(comments, HasLen, 2)
+	c.Check(loaded.NumComments, Equals, int32(2))
+	pending := loadPendingComments(m.ctx, 1)
+	c.Assert(pending, HasLen, 1)
+	c.Check(pending[0].Author, Equals, "Reader 2")
+	c.Check(pending[0].Rejected, Equals, false)
+	page, _, _ := loadCommentsPage(m.ctx, p, pageCursor{})
+	c.Check(page, HasLen, 2)
+}
+
+// legacyPost is a post as stored before the trash existed.
+type legacyPost struct {
+	Slug  *datastore.Key `gae:"$key"`
+	Title string         `gae:"title,noindex"`
+	Draft bool           `gae:"draft"`
+	Timestamps
+}
+
+func (m *ModelsTest) TestMigratePosts(c *C) {
+	config := loadConfig(m.ctx)
+	config.PostsMigrated = false
+	storeConfig(m.ctx, config)
+	admin := withAppPassword(m.ctx)
+
+	legacy := &legacyPost{Slug: createSlug(m.ctx, "legacy"), Title: "Legacy", Draft: true,
+		Timestamps: Timestamps{Created: created, Updated: created}}
+	c.Assert(datastore.Put(m.ctx, legacy), IsNil)
+	trashed, _ := testPost()
+	storePost(m.ctx, trashed)
+	trashPost(m.ctx, trashed)
+
+	// Unmigrated posts are listed, the trash is filtered after the query.
+	posts := newestPosts(admin, allPosts)
+	c.Assert(posts, HasLen, 1)
+	c.Check(posts[0].Title, Equals, "Legacy")
+
+	c.Check(migratePosts(m.ctx), Equals, 2)
+	c.Check(loadConfig(m.ctx).PostsMigrated, Equals, true)
+	posts = newestPosts(admin, allPosts)
+	c.Assert(posts, HasLen, 1)
+	c.Check(posts[0].Title, Equals, "Legacy")
+	c.Check(posts[0].Trashed, Equals, false)
+}
+
+func (m *ModelsTest) TestModerateComment(c *C) {
+	p, comments := testPost()
+	p.NumComments = 0
+	storePost(m.ctx, p)
+	for i := range comments {
+		comments[i].Approved = false
+		c.Assert(storeComment(m.ctx, p, &comments[i]), IsNil)
+	}
+
+	c.Check(getPendingCommentPageCount(m.ctx), Equals, 1)
+	pending := loadPendingComments(m.ctx, 1)
+	c.Assert(pending, HasLen, 2)
+	c.Check(pending[0].Author, Equals, "testAuthor2") // Newest first.
+	c.Check(pending[0].Post.Title, Equals, "Hello World")
+
+	c.Assert(moderateComment(m.ctx, comments[0].Key, moderationApprove), IsNil)
+	c.Assert(moderateComment(m.ctx, comments[1].Key, moderationReject), IsNil)
+	c.Check(loadPendingComments(m.ctx, 1), HasLen, 0)
+
+	loaded, visible := loadPost(m.ctx, p.Slug.StringID())
+	c.Check(loaded.NumComments, Equals, int32(1))
+	c.Check(visible, HasLen, 1)
+
+	c.Assert(moderateComment(m.ctx, comments[0].Key, moderationDelete), IsNil)
+	loaded, visible = loadPost(m.ctx, p.Slug.StringID())
+	c.Check(loaded.NumComments, Equals, int32(0))
+	c.Check(visible, HasLen, 0)
+
+	c.Check(moderateComment(m.ctx, comments[1].Key, "frobnicate"), NotNil)
+}
+
+func (m *ModelsTest) TestTrashRestorePurge(c *C) {
+	p, comments := testPost()
+	p.NumComments = 0
+	storePost(m.ctx, p)
+	for i := range comments {
+		c.Assert(storeComment(m.ctx, p, &comments[i]), IsNil)
+	}
+	c.Check(newestPosts(m.ctx, allPosts), HasLen, 1)
+
+	trashPost(m.ctx, p)
+	c.Check(p.Draft, Equals, true)
+	c.Check(newestPosts(m.ctx, allPosts), HasLen, 0)
+	c.Check(getPageCount(m.ctx, allPosts), Equals, 1)
+	trashed := loadTrashedPosts(m.ctx)
+	c.Assert(trashed, HasLen, 1)
+	c.Check(trashed[0].Title, Equals, "Hello World")
+
+	restorePost(m.ctx, p)
+	c.Check(loadTrashedPosts(m.ctx), HasLen, 0)
+	c.Check(p.Draft, Equals, true)
+
+	trashPost(m.ctx, p)
+	purgePost(m.ctx, p)
+	c.Check(loadTrashedPosts(m.ctx), HasLen, 0)
+	ex, err := datastore.Exists(m.ctx, p.Slug, comments[0].Key, comments[1].Key)
+	c.Assert(err, IsNil)
+	for i := 0; i < 3; i++ {
+		c.Check(ex.Get(i), Equals, false)
+	}
+}
+
+func (m *ModelsTest) TestRevisions(c *C) {
+	p, _ := testPost()
+	storePost(m.ctx, p)
+	p.Text = "Edited content"
+	storePost(m.ctx, p)
+
+	revisions := loadRevisions(m.ctx, p)
+	c.Assert(revisions, HasLen, 2)
+	c.Check(revisions[0].Text, Equals, "Edited content")
+	c.Check(revisions[1].Text, Equals, "Test content")
+
+	restoreRevision(m.ctx, p, &revisions[1])
+	loaded, _ := loadPost(m.ctx, p.Slug.StringID())
+	c.Check(loaded.Text, Equals, "Test content")
+	c.Check(loadRevisions(m.ctx, p), HasLen, 3)
+}
+
+func (m *ModelsTest) TestRenamePost(c *C) {
+	p, comments := testPost()
+	p.NumComments = 0
+	storePost(m.ctx, p)
+	for _, comment := range comments {
+		storeComment(m.ctx, p, &comment)
+	}
+
+	renamePost(m.ctx, p, "hello-gophers")
+	c.Check(p.Slug.StringID(), Equals, "hello-gophers")
+	loaded, loadedComments := loadPost(m.ctx, "hello-gophers")
+	c.Check(loaded.Title, Equals, "Hello World")
+	c.Check(loadedComments, HasLen, len(comments))
+	c.Check(loadRevisions(m.ctx, p), HasLen, 1)
+	c.Check(func() { loadPost(m.ctx, "hello-world") }, PanicMatches, "datastore: no such entity")
+	c.Check(loadRedirectedPost(m.ctx, "hello-world").Slug.StringID(), Equals, "hello-gophers")
+	c.Check(loadRedirectedPost(m.ctx, "hello-gophers"), IsNil)
+
+	// Chains of renames are followed, and renaming back drops the redirect.
+	renamePost(m.ctx, p, "hello-again")
+	c.Check(loadRedirectedPost(m.ctx, "hello-world").Slug.StringID(), Equals, "hello-again")
+	renamePost(m.ctx, p, "hello-world")
+	c.Check(loadRedirectedPost(m.ctx, "hello-world"), IsNil)
+	c.Check(loadRedirectedPost(m.ctx, "hello-gophers").Slug.StringID(), Equals, "hello-world")
+
+	other := &Post{Title: "Taken"}
+	storePost(m.ctx, other)
+	c.Check(func() { renamePost(m.ctx, p, "taken") }, PanicMatches, ".*a post with slug.*exists")
+	c.Check(p.Slug.StringID(), Equals, "hello-world")
+}
+
+func (m *ModelsTest) TestRenamePost_ReuseSlug(c *C) {
+	p, _ := testPost()
+	storePost(m.ctx, p)
+	renamePost(m.ctx, p, "hello-gophers")
+	c.Check(loadRedirectedPost(m.ctx, "hello-world"), NotNil)
+
+	// A new post under the old slug replaces the redirect.
+	other := &Post{Title: "Hello World again", Text: "Another post"}
+	storePostWithSlug(m.ctx, other, "hello-world")
+	c.Check(other.Slug.StringID(), Equals, "hello-world")
+	c.Check(loadRedirectedPost(m.ctx, "hello-world"), IsNil)
+	loaded, _ := loadPostIfExists(m.ctx, "hello-world")
+	c.Assert(loaded, NotNil)
+	c.Check(loaded.Title, Equals, "Hello World again")
+	loaded, _ = loadPostIfExists(m.ctx, "hello-nobody")
+	c.Check(loaded, IsNil)
+}
+
+func (m *ModelsTest) TestScheduledPublishing(c *C) {
+	now := time.Now().UTC()
+	publishAt := now.Add(time.Hour).Truncate(time.Minute)
+	p, _ := testPost()
+	p.Scheduled = true
+	p.PublishAt = publishAt
+	storePost(m.ctx, p)
+	c.Check(p.Draft, Equals, true)
+
+	c.Check(newestPosts(m.ctx, allPosts), HasLen, 0)
+	c.Check(func() { loadPost(m.ctx, p.Slug.StringID()) }, PanicMatches, "datastore: no such entity")
+	c.Check(publishDuePosts(m.ctx, now), Equals, 0)
+
+	lastUpdated := backdatePostsChanged(c, m.ctx)
+	c.Check(publishDuePosts(m.ctx, publishAt.Add(time.Minute)), Equals, 1)
+	posts := newestPosts(m.ctx, allPosts)
+	c.Assert(posts, HasLen, 1)
+	c.Check(posts[0].Draft, Equals, false)
+	c.Check(posts[0].Scheduled, Equals, false)
+	c.Check(posts[0].Created.Equal(publishAt), Equals, true)
+	c.Check(pageLastUpdated(m.ctx).After(lastUpdated), Equals, true)
+	c.Check(publishDuePosts(m.ctx, publishAt.Add(time.Hour)), Equals, 0)
+}
+
+func (m *ModelsTest) TestPreviewLinks(c *C) {
+	p, _ := testPost()
+	p.Draft = true
+	storePost(m.ctx, p)
+	link := createPreviewLink(m.ctx, p, time.Hour)
+	createPreviewLink(m.ctx, p, -time.Hour)
+
+	links := loadPreviewLinks(m.ctx, p)
+	c.Assert(links, HasLen, 1)
+	c.Check(links[0].Url, Equals, link.Url)
+	// The secret is stable, so links stay valid.
+	c.Check(loadPreviewLinks(m.ctx, p)[0].Url, Equals, link.Url)
+
+	token := string(link.Url)
+	token = token[strings.LastIndex(token, "/")+1:]
+	c.Check(loadPreviewPost(m.ctx, p.Slug.StringID(), token).Title, Equals, "Hello World")
+	c.Check(func() { loadPreviewPost(m.ctx, "other-post", token) }, PanicMatches, "datastore: no such entity")
+}
+
+func (m *ModelsTest) TestPostSummary(c *C) {
+	p := &Post{Text: "Whole post"}
+	c.Check(p.Summary(), Equals, "")
+	p.Text = "Intro\n\n<!--more-->\n\nRest"
+	c.Check(p.Summary(), Equals, "Intro\n\n")
+	p.Excerpt = "Excerpt"
+	c.Check(p.Summary(), Equals, "Excerpt")
+}
+
+func (m *ModelsTest) TestRenderedHtml(c *C) {
+	p, comments := testPost()
+	p.Text = "Some *markdown*"
+	storePost(m.ctx, p)
+	storeComment(m.ctx, p, &comments[0])
+
+	loaded, loadedComments := loadPost(m.ctx, p.Slug.StringID())
+	c.Check(loaded.RenderVersion, Equals, int32(markdownVersion))
+	c.Check(loaded.RenderedText, Equals, "<p>Some <em>markdown</em></p>\n")
+	c.Check(loadedComments[0].RenderedText, Equals, "<p>textText1</p>\n")
+
+	// HTML stored by an older renderer is not used.
+	loaded.RenderedText = "stale"
+	c.Check(string(loaded.Html()), Equals, "stale")
+	loaded.RenderVersion = markdownVersion - 1
+	c.Check(string(loaded.Html()), Equals, "<p>Some <em>markdown</em></p>\n")
+}
+
+func (m *ModelsTest) TestRerenderPosts(c *C) {
+	p, comments := testPost()
+	p.NumComments = 0
+	p.Text = "Intro\n\n<!--more-->\n\nRest"
+	storePost(m.ctx, p)
+	c.Assert(storeComment(m.ctx, p, &comments[0]), IsNil)
+	current := &Post{Title: "Current", Text: "Current"}
+	storePost(m.ctx, current)
+
+	// As stored before HTML was stored with posts.
+	p.RenderedText, p.RenderedSummary, p.RenderVersion = "", "", 0
+	comments[0].RenderedText, comments[0].RenderVersion = "", 0
+	c.Assert(datastore.Put(m.ctx, p, &comments[0]), IsNil)
+	c.Check(string(p.SummaryHtml()), Equals, "<p>Intro</p>\n")
+
+	c.Check(rerenderPosts(m.ctx), Equals, 2)
+	loaded, loadedComments := loadPost(m.ctx, p.Slug.StringID())
+	c.Check(loaded.RenderVersion, Equals, int32(markdownVersion))
+	c.Check(loaded.RenderedSummary, Equals, "<p>Intro</p>\n")
+	c.Check(loadedComments[0].RenderedText, Equals, "<p>textText1</p>\n")
+	c.Check(loadConfig(m.ctx).RenderVersion, Equals, int32(markdownVersion))
+	c.Check(rerenderPosts(m.ctx), Equals, 0)
+}
+
+func (m *ModelsTest) TestDiffLines(c *C) {
+	diff := diffLines("a\nb\nc\nd\n", "a\nc\nx\nd")
+	c.Check(diff, DeepEquals, []DiffLine{
+		{DiffEqual, "a"},
+		{DiffDelete, "b"},
+		{DiffEqual, "c"},
+		{DiffInsert, "x"},
+		{DiffEqual, "d"},
+	})
+	c.Check(diffLines("", "new"), DeepEquals, []DiffLine{{DiffInsert, "new"}})
+	c.Check(diffLines("same", "same"), DeepEquals, []DiffLine{{DiffEqual, "same"}})
+}
+
+func (m *ModelsTest) TestParseTags(c *C) {
+	c.Check(parseTags(""), HasLen, 0)
+	c.Check(parseTags("Go, web development,go, ,App Engine"), DeepEquals,
+		[]string{"go", "web-development", "app-engine"})
+}
+
+func (m *ModelsTest) TestTags(c *C) {
+	for i := 0; i < 3; i++ {
+		p := &Post{Title: fmt.Sprintf("t%d", i), Tags: []string{"all"}}
+		if i%2 == 0 {
+			p.Tags = append(p.Tags, "even")
+		}
+		storePost(m.ctx, p)
+	}
+	draft := &Post{Title: "draft", Tags: []string{"even", "secret"}, Draft: true}
+	storePost(m.ctx, draft)
+
+	c.Check(newestPosts(m.ctx, postSelection{Tag: "all"}), HasLen, 3)
+	c.Check(newestPosts(m.ctx, postSelection{Tag: "even"}), HasLen, 2)
+	c.Check(newestPosts(m.ctx, postSelection{Tag: "secret"}), HasLen, 0)
+	c.Check(getPageCount(m.ctx, postSelection{Tag: "even"}), Equals, 1)
+
+	c.Check(loadTagCounts(m.ctx), DeepEquals, []TagCount{{"all", 3}, {"even", 2}})
+}
+
+func (m *ModelsTest) TestArchive(c *C) {
+	for i, created := range []time.Time{
+		time.Date(2013, 12, 31, 23, 0, 0, 0, time.UTC),
+		time.Date(2014, 3, 7, 10, 0, 0, 0, time.UTC),
+		time.Date(2014, 3, 7, 11, 0, 0, 0, time.UTC),
+		time.Date(2014, 5, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		storePost(m.ctx, &Post{
+			Title:      fmt.Sprintf("t%d", i),
+			Timestamps: Timestamps{Created: created, Updated: created},
+		})
+	}
+
+	march := postSelection{Year: 2014, Month: 3}
+	c.Check(march.path(), Equals, "2014/03/")
+	c.Check(march.title(), Equals, "Posts from March 2014")
+	c.Check(newestPosts(m.ctx, march), HasLen, 2)
+	c.Check(newestPosts(m.ctx, postSelection{Year: 2014}), HasLen, 3)
+	c.Check(newestPosts(m.ctx, postSelection{Year: 2014, Month: 3, Day: 7}), HasLen, 2)
+	c.Check(newestPosts(m.ctx, postSelection{Year: 2014, Month: 4}), HasLen, 0)
+
+	newer, older := adjacentPeriods(m.ctx, march)
+	c.Check(*newer, Equals, postSelection{Year: 2014, Month: 5})
+	c.Check(*older, Equals, postSelection{Year: 2013, Month: 12})
+	newer, older = adjacentPeriods(m.ctx, postSelection{Year: 2013})
+	c.Check(*newer, Equals, postSelection{Year: 2014})
+	c.Check(older, IsNil)
+
+	c.Check(loadArchive(m.ctx), DeepEquals, []ArchiveYear{
+		{2014, 3, []ArchiveMonth{{2014, time.May, 1}, {2014, time.March, 2}}},
+		{2013, 1, []ArchiveMonth{{2013, time.December, 1}}},
+	})
+}
+
 var updated = time.Now().UTC().Truncate(1 * time.Second)
 var created = updated.Add(-20 * time.Minute)
 
@@ -115,17 +774,55 @@ func testPost() (*Post, []Comment) {
 		NumComments: 2,
 	}
 	comments := []Comment{Comment{
-		Author: "testAuthor1",
-		Text:   "textText1",
+		Author:   "testAuthor1",
+		Text:     "textText1",
+		Approved: true,
 		Timestamps: Timestamps{
 			Created: created.Add(20 * time.Minute),
 		},
 	}, Comment{
-		Author: "testAuthor2",
-		Text:   "textText2",
+		Author:   "testAuthor2",
+		Text:     "textText2",
+		Approved: true,
 		Timestamps: Timestamps{
 			Created: created.Add(40 * time.Minute),
 		},
 	}}
 	return &p, comments
 }
+
+func (m *ModelsTest) TestLoadCommentsPage(c *C) {
+	p, _ := testPost()
+	p.NumComments = 0
+	storePost(m.ctx, p)
+	draft := &Post{Title: "Draft", Draft: true}
+	storePost(m.ctx, draft)
+	for i := 0; i < commentsPerPage+5; i++ {
+		comment := &Comment{Author: fmt.Sprintf("Reader %d", i), Text: "Hi.", Approved: i != 0,
+			Timestamps: Timestamps{Created: created.Add(time.Duration(i) * time.Minute)}}
+		c.Assert(storeComment(m.ctx, p, comment), IsNil)
+	}
+	c.Assert(storeComment(m.ctx, draft, &Comment{Author: "Other", Text: "Hi.", Approved: true}), IsNil)
+
+	comments, newer, older := loadCommentsPage(m.ctx, p, pageCursor{})
+	c.Assert(comments, HasLen, commentsPerPage)
+	c.Check(comments[0].Author, Equals, fmt.Sprintf("Reader %d", commentsPerPage+4))
+	c.Check(comments[0].Post.Title, Equals, "Hello World")
+	c.Check(newer, IsNil)
+	c.Assert(older, NotNil)
+
+	// The oldest, unapproved comment is left out.
+	comments, newer, older = loadCommentsPage(m.ctx, p, *older)
+	c.Assert(comments, HasLen, 4)
+	c.Check(comments[3].Author, Equals, "Reader 1")
+	c.Check(older, IsNil)
+	c.Assert(newer, NotNil)
+	comments, _, _ = loadCommentsPage(m.ctx, p, *newer)
+	c.Check(comments, HasLen, commentsPerPage)
+
+	// Comments on drafts don't show up for all posts.
+	comments, _, _ = loadCommentsPage(m.ctx, nil, pageCursor{})
+	for _, comment := range comments {
+		c.Check(comment.Author, Not(Equals), "Other")
+	}
+}
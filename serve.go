@@ -1,11 +1,21 @@
 package blog
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/net/context"
 
@@ -24,7 +34,18 @@ import (
 
 var router = mux.NewRouter()
 var routeShowPost,
-	routeEditPost *mux.Route
+	routeEditPost,
+	routeAddComment,
+	routeRevisions,
+	routePreview,
+	routePreviews,
+	routeTag,
+	routeTagFeed,
+	routeCommentsFeed,
+	routeAtomPubCollection,
+	routeAtomPubMember,
+	routeMedia,
+	routeTrash *mux.Route
 
 func init() {
 	// Use app code to render all 404s.
@@ -54,15 +75,60 @@ func init() {
 	})
 
 	s.Handle("/", appEngineHandler(indexPage))
+	// Date archives, registered before the index pages to take precedence.
+	year, month, day := "/{year:\\d{4}}/", "{month:\\d{1,2}}/", "{day:\\d{1,2}}/"
+	for _, archive := range []string{year, year + month, year + month + day} {
+		s.Handle(archive, appEngineHandler(archivePage))
+		s.Handle(archive+"page/{page:\\d+}/", appEngineHandler(archivePage))
+	}
+	s.Handle("/archive/", appEngineHandler(archiveIndex))
 	s.Handle("/{page:\\d*}/", appEngineHandler(indexPage))
 
-	s.Handle("/feed", http.RedirectHandler("/blog/feed/1", http.StatusMovedPermanently))
+	s.Handle("/feed", http.RedirectHandler("/blog/feed/", http.StatusMovedPermanently))
 	s.Handle("/feed/{page:\\d*}", appEngineHandler(feed))
+	s.Handle("/rss", appEngineHandler(rssFeed))
+	s.Handle("/feed.json", appEngineHandler(jsonFeed))
+
+	s.Handle("/tag/", appEngineHandler(tagIndex))
+	routeTag = s.Handle("/tag/{tag}/", appEngineHandler(tagPage))
+	s.Handle("/tag/{tag}/{page:\\d*}/", appEngineHandler(tagPage))
+	s.Handle("/tag/{tag}/feed", appEngineHandler(redirectToTagFeed))
+	routeTagFeed = s.Handle("/tag/{tag}/feed/{page:\\d*}", appEngineHandler(feed))
+	s.Handle("/tag/{tag}/rss", appEngineHandler(rssFeed))
+	s.Handle("/tag/{tag}/feed.json", appEngineHandler(jsonFeed))
 
 	s.Handle("/new", appEngineHandler(editPost))
 	postPrefix := "/{ymd:\\d{4}/\\d{1,2}/\\d{1,2}}/{slug}/"
 	routeShowPost = s.Handle(postPrefix, appEngineHandler(showPost))
 	routeEditPost = s.Handle(postPrefix+"edit", appEngineHandler(editPost))
+	routeRevisions = s.Handle(postPrefix+"edit/revisions", appEngineHandler(postRevisions))
+	routePreviews = s.Handle(postPrefix+"edit/previews", appEngineHandler(managePreviews)).Methods("POST")
+	routeAddComment = s.Handle(postPrefix+"comment", appEngineHandler(addComment)).Methods("POST")
+	routePreview = s.Handle(postPrefix+"preview/{token}", appEngineHandler(previewPost))
+	routeCommentsFeed = s.Handle(postPrefix+"comments/feed", appEngineHandler(commentsFeed))
+	s.Handle("/comments/feed", appEngineHandler(commentsFeed))
+
+	s.Handle("/admin/comments/", appEngineHandler(moderateComments))
+	s.Handle("/admin/comments/{page:\\d+}/", appEngineHandler(moderateComments))
+	routeTrash = s.Handle("/admin/trash/", appEngineHandler(manageTrash))
+	s.Handle("/admin/settings", appEngineHandler(editSettings))
+	s.Handle("/admin/publish_scheduled", appEngineHandler(publishScheduled))
+	s.Handle("/admin/migrate_comments", appEngineHandler(migrateCommentsHandler))
+	s.Handle("/admin/migrate_posts", appEngineHandler(migratePostsHandler))
+	s.Handle("/admin/recount_posts", appEngineHandler(recountPosts))
+	s.Handle("/admin/rerender_posts", appEngineHandler(rerenderPostsHandler))
+	s.Handle("/admin/verify_webmention", appEngineHandler(verifyWebmention)).Methods("POST")
+
+	// Atom Publishing Protocol, see atompub.go.
+	s.Handle("/atompub", appEngineHandler(atomPubServiceDocument))
+	routeAtomPubCollection = s.Handle("/atompub/posts", appEngineHandler(atomPubCollection))
+	routeAtomPubMember = s.Handle("/atompub/posts/{slug}", appEngineHandler(atomPubMember))
+	routeMedia = s.Handle("/media/{name}", appEngineHandler(serveMedia))
+	s.Handle("/micropub", appEngineHandler(micropub))
+	s.Handle("/webmention", appEngineHandler(webmention))
+
+	// MetaWeblog and Blogger APIs, see xmlrpc.go.
+	router.Handle("/xmlrpc", appEngineHandler(xmlrpcHandler))
 
 	router.HandleFunc("/.well-known/acme-challenge/{challenge}", func(rw http.ResponseWriter, req *http.Request) {
 		c := mux.Vars(req)["challenge"]
@@ -132,28 +198,193 @@ func redirectToDomain(c context.Context, rw http.ResponseWriter, r *http.Request
 	http.Redirect(rw, r, url, http.StatusMovedPermanently)
 }
 
-func loadPostsPage(c context.Context, r *http.Request) ([]Post, int, int) {
-	page, err := strconv.Atoi(mux.Vars(r)["page"])
+// loadPostsPage loads the page of posts selected by the request's query.
+// Numbered pages from older URLs are permanently redirected to the same page
+// below path, in which case ok is false and nothing should be rendered.
+func loadPostsPage(c context.Context, w http.ResponseWriter, r *http.Request, sel postSelection, path string) (posts []Post, nav Navigation, ok bool) {
+	if page := mux.Vars(r)["page"]; page != "" {
+		number, _ := strconv.Atoi(page)
+		u := &url.URL{Path: path, RawQuery: legacyPageCursor(c, sel, number).queryString()}
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		return nil, nav, false
+	}
+	cur, err := parsePageCursor(r.URL.Query())
 	if err != nil {
-		page = 1
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nav, false
 	}
-	posts := loadPosts(c, page)
-	count := getPageCount(c)
-	if page > count {
+	posts, newer, older := loadPosts(c, sel, cur)
+	if len(posts) == 0 && !cur.isZero() {
 		panic(datastore.ErrNoSuchEntity)
 	}
-	return posts, page, count
+	return posts, createNavigation(sel.path(), cur, newer, older), true
 }
 
 func indexPage(c context.Context, w http.ResponseWriter, r *http.Request) {
-	posts, page, count := loadPostsPage(c, r)
-	renderPosts(w, posts, page, count)
+	posts, nav, ok := loadPostsPage(c, w, r, allPosts, baseUri)
+	if !ok {
+		return
+	}
+	serveConditional(c, w, r, htmlContentType, pageLastUpdated(c), func(w io.Writer) {
+		renderPosts(w, posts, allPosts, nav)
+	})
+}
+
+func tagPage(c context.Context, w http.ResponseWriter, r *http.Request) {
+	sel := postSelection{Tag: mux.Vars(r)["tag"]}
+	posts, nav, ok := loadPostsPage(c, w, r, sel, baseUri+sel.path())
+	if !ok {
+		return
+	}
+	if len(posts) == 0 {
+		panic(datastore.ErrNoSuchEntity)
+	}
+	serveConditional(c, w, r, htmlContentType, pageLastUpdated(c), func(w io.Writer) {
+		renderPosts(w, posts, sel, nav)
+	})
+}
+
+func archivePage(c context.Context, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var sel postSelection
+	sel.Year, _ = strconv.Atoi(vars["year"])
+	sel.Month, _ = strconv.Atoi(vars["month"])
+	sel.Day, _ = strconv.Atoi(vars["day"])
+	// Reject out of range dates, which time.Date would silently normalize.
+	start, _ := sel.span()
+	if (sel.Month != 0 && int(start.Month()) != sel.Month) || (sel.Day != 0 && start.Day() != sel.Day) {
+		panic(datastore.ErrNoSuchEntity)
+	}
+
+	posts, nav, ok := loadPostsPage(c, w, r, sel, baseUri+sel.path())
+	if !ok {
+		return
+	}
+	if len(posts) == 0 {
+		panic(datastore.ErrNoSuchEntity)
+	}
+	newer, older := adjacentPeriods(c, sel)
+	serveConditional(c, w, r, htmlContentType, pageLastUpdated(c), func(w io.Writer) {
+		renderArchive(w, posts, sel, nav, newer, older)
+	})
+}
+
+func archiveIndex(c context.Context, w http.ResponseWriter, r *http.Request) {
+	renderArchiveIndex(w, loadArchive(c))
+}
+
+func tagIndex(c context.Context, w http.ResponseWriter, r *http.Request) {
+	renderTagIndex(w, loadTagCounts(c))
 }
 
+// feedRenderer renders a page of posts in one of the feed formats.
+type feedRenderer func(wr io.Writer, posts []Post, lastUpdated time.Time, sel postSelection, nav Navigation, config *Config, site string)
+
 func feed(c context.Context, w http.ResponseWriter, r *http.Request) {
-	posts, page, count := loadPostsPage(c, r)
+	serveFeed(c, w, r, "feed/", atomContentType, renderPostsFeed)
+}
+
+func rssFeed(c context.Context, w http.ResponseWriter, r *http.Request) {
+	serveFeed(c, w, r, "rss", rssContentType, renderRSSFeed)
+}
+
+func jsonFeed(c context.Context, w http.ResponseWriter, r *http.Request) {
+	serveFeed(c, w, r, "feed.json", jsonFeedContentType, renderJSONFeed)
+}
+
+// serveFeed serves the page of posts selected by the request as a feed. name
+// is the feed's path relative to the listing it is a feed for.
+func serveFeed(c context.Context, w http.ResponseWriter, r *http.Request, name, contentType string, render feedRenderer) {
+	sel := postSelection{Tag: mux.Vars(r)["tag"]}
+	posts, nav, ok := loadPostsPage(c, w, r, sel, baseUri+sel.path()+name)
+	if !ok {
+		return
+	}
+	if sel.Tag != "" && len(posts) == 0 {
+		panic(datastore.ErrNoSuchEntity)
+	}
 	lastUpdated := pageLastUpdated(c)
-	renderPostsFeed(w, posts, lastUpdated, page, count)
+	config, site := loadFeedConfig(c, r)
+	serveConditional(c, w, r, contentType, lastUpdated, func(w io.Writer) {
+		render(w, posts, lastUpdated, sel, nav, config, site)
+	})
+}
+
+// commentsFeed serves the approved comments on a post, or on all posts if the
+// request doesn't select one, as an Atom feed.
+func commentsFeed(c context.Context, w http.ResponseWriter, r *http.Request) {
+	cur, err := parsePageCursor(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var post *Post
+	path := "comments/"
+	if slug, ok := mux.Vars(r)["slug"]; ok {
+		post = loadVisiblePost(c, slug)
+		path = strings.TrimPrefix(string(post.Url()), baseUri) + path
+	}
+	comments, newer, older := loadCommentsPage(c, post, cur)
+	if len(comments) == 0 && !cur.isZero() {
+		panic(datastore.ErrNoSuchEntity)
+	}
+	nav := createNavigation(path, cur, newer, older)
+
+	var lastUpdated time.Time
+	if post != nil {
+		lastUpdated = post.Updated
+	}
+	for _, comment := range comments {
+		if comment.Updated.After(lastUpdated) {
+			lastUpdated = comment.Updated
+		}
+	}
+	config, site := loadFeedConfig(c, r)
+	serveConditional(c, w, r, atomContentType, lastUpdated, func(w io.Writer) {
+		renderCommentsFeed(w, comments, post, lastUpdated, nav, config, site)
+	})
+}
+
+// loadFeedConfig loads the config for rendering feeds, along with the URL of
+// the site, and sets up the tag URIs identifying feeds on first use.
+func loadFeedConfig(c context.Context, r *http.Request) (config *Config, site string) {
+	config = loadConfig(c)
+	site = siteURL(config, r)
+	if config.TagAuthority == "" {
+		u, err := url.Parse(site)
+		if err != nil {
+			panic(err)
+		}
+		if config.BaseURL != "" {
+			initTagAuthority(c, config, defaultTagAuthority(c, u.Hostname()))
+		} else {
+			// Any host may be requested, so it is not stored until the base URL
+			// is configured.
+			config.TagAuthority = defaultTagAuthority(c, u.Hostname())
+		}
+	}
+	return config, site
+}
+
+// siteURL returns the scheme and host the blog is served from, as configured
+// or as requested.
+func siteURL(config *Config, r *http.Request) string {
+	if config.BaseURL != "" {
+		return strings.TrimSuffix(config.BaseURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func redirectToTagFeed(c context.Context, w http.ResponseWriter, r *http.Request) {
+	url, err := routeTagFeed.URL("tag", mux.Vars(r)["tag"], "page", "")
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, url.String(), http.StatusMovedPermanently)
 }
 
 func showPost(c context.Context, w http.ResponseWriter, r *http.Request) {
@@ -162,20 +393,278 @@ func showPost(c context.Context, w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		panic(datastore.ErrNoSuchEntity) // hack, hack
 	}
+	post, comments := loadPostIfExists(c, slug)
+	if post == nil {
+		if renamed := loadRedirectedPost(c, slug); renamed != nil {
+			http.Redirect(w, r, renamed.Route(routeShowPost).String(), http.StatusMovedPermanently)
+			return
+		}
+		panic(datastore.ErrNoSuchEntity)
+	}
+	if vars["ymd"] != post.Created.Format("2006/01/02") {
+		// Any date serves the post, so send readers and crawlers to the real one.
+		u := post.Route(routeShowPost)
+		u.RawQuery = r.URL.RawQuery
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		return
+	}
+	form := &CommentForm{Pending: r.URL.Query().Get("comment") == "pending"}
+	// Comments don't update the post, but change the page.
+	lastModified := post.lastModified(time.Time{})
+	for _, comment := range comments {
+		if comment.Updated.After(lastModified) {
+			lastModified = comment.Updated
+		}
+		if comment.Created.After(lastModified) {
+			lastModified = comment.Created
+		}
+	}
+	w.Header().Set("Link", `<`+baseUri+`webmention>; rel="webmention"`)
+	serveConditional(c, w, r, htmlContentType, lastModified, func(w io.Writer) {
+		renderPost(w, post, comments, form)
+	})
+}
+
+const (
+	htmlContentType     = "text/html; charset=utf-8"
+	atomContentType     = "application/atom+xml; charset=utf-8"
+	rssContentType      = "application/rss+xml; charset=utf-8"
+	jsonFeedContentType = "application/feed+json; charset=utf-8"
+)
+
+// serveConditional renders a page and serves it, answering conditional GETs
+// with 304 Not Modified. The page's strong ETag is a hash of its content.
+func serveConditional(c context.Context, w http.ResponseWriter, r *http.Request,
+	contentType string, lastModified time.Time, render func(w io.Writer)) {
+	var buffer bytes.Buffer
+	render(&buffer)
+	hash := sha256.Sum256(buffer.Bytes())
+
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("ETag", `"`+base64.RawURLEncoding.EncodeToString(hash[:16])+`"`)
+	if isAdmin(c) {
+		// Admins see drafts and unapproved comments, which must not be cached.
+		header.Set("Cache-Control", "private, no-store")
+	} else {
+		// Caches may keep the page, but have to check whether it changed.
+		header.Set("Cache-Control", "public, no-cache")
+	}
+	// Handles If-None-Match and If-Modified-Since, and sets Last-Modified.
+	http.ServeContent(w, r, "", lastModified, bytes.NewReader(buffer.Bytes()))
+}
+
+// CommentForm holds the fields of a reader submitted comment, along with any
+// validation errors keyed by field name.
+type CommentForm struct {
+	Author, AuthorEmail, AuthorUrl, Text string
+
+	Errors  map[string][]string
+	Pending bool
+}
+
+const (
+	maxCommentAuthorLength = 100
+	maxCommentTextLength   = 10000
+)
+
+func (f *CommentForm) addError(field, msg string) {
+	if f.Errors == nil {
+		f.Errors = make(map[string][]string)
+	}
+	f.Errors[field] = append(f.Errors[field], msg)
+}
+
+// validate normalizes the form's fields and records errors for invalid ones.
+// It returns true if the form can be stored as a comment.
+func (f *CommentForm) validate() bool {
+	f.Author = strings.TrimSpace(f.Author)
+	f.AuthorEmail = strings.TrimSpace(f.AuthorEmail)
+	f.AuthorUrl = strings.TrimSpace(f.AuthorUrl)
+	f.Text = strings.TrimSpace(f.Text)
+
+	if f.Author == "" {
+		f.addError("Author", "required")
+	} else if utf8.RuneCountInString(f.Author) > maxCommentAuthorLength {
+		f.addError("Author", "too long")
+	}
+
+	if f.AuthorEmail == "" {
+		f.addError("AuthorEmail", "required")
+	} else if addr, err := mail.ParseAddress(f.AuthorEmail); err != nil || addr.Address != f.AuthorEmail {
+		f.addError("AuthorEmail", "not a valid email address")
+	}
+
+	if f.AuthorUrl != "" {
+		if !strings.Contains(f.AuthorUrl, "://") {
+			f.AuthorUrl = "http://" + f.AuthorUrl
+		}
+		u, err := url.Parse(f.AuthorUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			f.addError("AuthorUrl", "not a valid web address")
+		}
+	}
+
+	if f.Text == "" {
+		f.addError("Text", "required")
+	} else if utf8.RuneCountInString(f.Text) > maxCommentTextLength {
+		f.addError("Text", "too long")
+	}
+
+	return len(f.Errors) == 0
+}
+
+func addComment(c context.Context, w http.ResponseWriter, r *http.Request) {
+	slug, ok := mux.Vars(r)["slug"]
+	if !ok {
+		panic(datastore.ErrNoSuchEntity)
+	}
 	post, comments := loadPost(c, slug)
-	renderPost(w, post, comments)
+
+	if err := r.ParseForm(); err != nil {
+		panic(err)
+	}
+	form := &CommentForm{
+		Author:      r.PostForm.Get("Author"),
+		AuthorEmail: r.PostForm.Get("AuthorEmail"),
+		AuthorUrl:   r.PostForm.Get("AuthorUrl"),
+		Text:        r.PostForm.Get("Text"),
+	}
+	if !form.validate() {
+		w.WriteHeader(http.StatusBadRequest)
+		renderPost(w, post, comments, form)
+		return
+	}
+
+	now := time.Now().UTC()
+	comment := &Comment{
+		Author:      form.Author,
+		AuthorEmail: form.AuthorEmail,
+		AuthorUrl:   form.AuthorUrl,
+		Text:        form.Text,
+		Approved:    false, // Held for moderation.
+		Timestamps: Timestamps{
+			Created: now,
+			Updated: now,
+		},
+	}
+	if err := storeComment(c, post, comment); err != nil {
+		panic(err)
+	}
+	logging.Infof(c, "Stored comment by %s on %s, pending moderation", comment.Author, post.Url())
+
+	url := post.Route(routeShowPost)
+	url.RawQuery = "comment=pending"
+	url.Fragment = "comment_form"
+	http.Redirect(w, r, url.String(), http.StatusSeeOther)
 }
 
 var decoder = schema.NewDecoder()
 
+// requireAdmin redirects users that are not admins to the login page. Returns
+// true if the user is an admin and the request should proceed.
+func requireAdmin(c context.Context, w http.ResponseWriter, r *http.Request) bool {
+	if user.IsAdmin(c) {
+		return true
+	}
+	url, err := user.LoginURL(c, r.RequestURI)
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+	return false
+}
+
+// requireAdminAPI responds with 401 Unauthorized to API clients that are
+// neither signed in as admins nor send the app password, using HTTP basic
+// authentication or as an OAuth bearer token. Returns the context to proceed
+// with if they are.
+func requireAdminAPI(c context.Context, w http.ResponseWriter, r *http.Request) (context.Context, bool) {
+	if isAdmin(c) {
+		return c, true
+	}
+	password, ok := accessToken(r)
+	if !ok {
+		_, password, ok = r.BasicAuth()
+	}
+	if ok && checkAppPassword(loadConfig(c), password) {
+		return withAppPassword(c), true
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="blog"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return c, false
+}
+
+// requireAccessToken is like requireAdminAPI, but only accepts the app
+// password as an OAuth bearer token. Endpoints that browsers can post forms
+// to cross-site use it, as they must not act on the admin's session cookie.
+func requireAccessToken(c context.Context, w http.ResponseWriter, r *http.Request) (context.Context, bool) {
+	if password, ok := accessToken(r); ok && checkAppPassword(loadConfig(c), password) {
+		return withAppPassword(c), true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="blog"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return c, false
+}
+
+// accessToken returns the OAuth bearer token sent in the Authorization
+// header or the access_token parameter (RFC 6750). The latter parses the
+// request's form.
+func accessToken(r *http.Request) (string, bool) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer "), true
+	}
+	if token := r.FormValue("access_token"); token != "" {
+		return token, true
+	}
+	return "", false
+}
+
+// formNonceCookie holds a random nonce per browser session, which the tokens
+// of the admin's forms are signed for.
+const formNonceCookie = "form_nonce"
+
+// sessionFormToken returns the token for the admin's forms, starting a
+// session if there is none yet.
+func sessionFormToken(c context.Context, w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(formNonceCookie); err == nil && cookie.Value != "" {
+		return formToken(c, cookie.Value)
+	}
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     formNonceCookie,
+		Value:    nonce,
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return formToken(c, nonce)
+}
+
+// requireFormToken responds with 403 Forbidden to forms that were posted
+// without the session's token, e.g. from another site. Returns true if the
+// request should proceed. It parses the request's form.
+func requireFormToken(c context.Context, w http.ResponseWriter, r *http.Request) bool {
+	if err := r.ParseForm(); err != nil {
+		panic(err)
+	}
+	cookie, err := r.Cookie(formNonceCookie)
+	if err == nil && cookie.Value != "" &&
+		hmac.Equal([]byte(r.PostForm.Get("form_token")), []byte(formToken(c, cookie.Value))) {
+		return true
+	}
+	logging.Warningf(c, "Form posted without a valid token")
+	http.Error(w, "Invalid form token, please reload the page and try again", http.StatusForbidden)
+	return false
+}
+
 func editPost(c context.Context, w http.ResponseWriter, r *http.Request) {
-	if !user.IsAdmin(c) {
-		// info.Get(c).
-		url, err := user.LoginURL(c, r.RequestURI)
-		if err != nil {
-			panic(err)
-		}
-		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+	if !requireAdmin(c, w, r) {
 		return
 	}
 
@@ -189,28 +678,372 @@ func editPost(c context.Context, w http.ResponseWriter, r *http.Request) {
 		p = &Post{}
 		p.Created = time.Now().UTC()
 	}
-	var action string
+	var action, slug string
+	// Errors by form field.
+	errors := map[string]string{}
 
 	if r.Method == "POST" {
-		if err := r.ParseForm(); err != nil {
-			panic(err)
+		if !requireFormToken(c, w, r) {
+			return
 		}
+		r.Form.Del("form_token") // Checked above, not a field of the post
 		logging.Infof(c, "Form data: %v", r.Form)
 		action = r.Form.Get("action")
+		if action == "Trash" && p.Slug != nil {
+			trashPost(c, p)
+			url, err := routeTrash.URL()
+			if err != nil {
+				panic(err)
+			}
+			http.Redirect(w, r, url.String(), http.StatusSeeOther)
+			return
+		}
 		r.Form.Del("action") // The button used to post, not of interest below
 		p.Draft = false      // Default to false, unless the form contains true
+		p.Tags = parseTags(r.Form.Get("Tags"))
+		r.Form.Del("Tags") // Comma separated, parsed above
+		slug = slugHint(r.Form.Get("Slug"))
+		r.Form.Del("Slug") // The key, handled below
+		if p.Slug != nil && slug != "" && slug != p.Slug.StringID() && postExists(c, slug) {
+			errors["Slug"] = "is taken by another post"
+		}
+		scheduled, publishAt, err := parsePublishAt(r.Form.Get("PublishAt"))
+		if err != nil {
+			errors["PublishAt"] = "not a valid date and time"
+		} else {
+			p.Scheduled, p.PublishAt = scheduled, publishAt
+		}
+		r.Form.Del("PublishAt")
 		if err := decoder.Decode(p, r.Form); err != nil {
 			panic(err)
 		}
 	}
 	p.Updated = time.Now().UTC()
 
-	if r.Method == "POST" && action == "Post" {
-		storePost(c, p)
+	if len(errors) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	} else if r.Method == "POST" && action == "Post" {
+		if p.Slug == nil {
+			storePostWithSlug(c, p, slug)
+		} else {
+			storePost(c, p)
+			if slug != "" && slug != p.Slug.StringID() {
+				renamePost(c, p, slug)
+			}
+		}
 		url := p.Route(routeShowPost)
 		http.Redirect(w, r, url.String(), http.StatusSeeOther)
 		return
 	}
 
-	renderEditPost(w, p)
+	var previews []PreviewLink
+	if p.Slug != nil {
+		previews = loadPreviewLinks(c, p)
+	}
+	renderEditPost(w, p, previews, slug, errors, sessionFormToken(c, w, r))
+}
+
+// publishAtFormat is the format of datetime-local inputs.
+const publishAtFormat = "2006-01-02T15:04"
+
+// parsePublishAt parses the publication time of a post, given in UTC. Only
+// times in the future schedule the post.
+func parsePublishAt(value string) (scheduled bool, publishAt time.Time, err error) {
+	if value == "" {
+		return false, time.Time{}, nil
+	}
+	publishAt, err = time.ParseInLocation(publishAtFormat, value, time.UTC)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if !publishAt.After(time.Now()) {
+		return false, time.Time{}, nil
+	}
+	return true, publishAt, nil
+}
+
+// publishScheduled is run by cron to publish scheduled posts that are due.
+func publishScheduled(c context.Context, w http.ResponseWriter, r *http.Request) {
+	// App Engine strips this header from requests that don't come from cron.
+	if r.Header.Get("X-Appengine-Cron") != "true" && !requireAdmin(c, w, r) {
+		return
+	}
+	published := publishDuePosts(c, time.Now().UTC())
+	fmt.Fprintf(w, "Published %d posts\n", published)
+}
+
+// recountPosts is run by cron to correct the published post counter.
+func recountPosts(c context.Context, w http.ResponseWriter, r *http.Request) {
+	// App Engine strips this header from requests that don't come from cron.
+	if r.Header.Get("X-Appengine-Cron") != "true" && !requireAdmin(c, w, r) {
+		return
+	}
+	count := rebuildPublishedPostCount(c)
+	// Drops the cached page count.
+	invalidatePostCaches(c)
+	fmt.Fprintf(w, "Counted %d published posts\n", count)
+}
+
+// migrateCommentsHandler is run by cron to index comments stored before
+// moderation existed. It does nothing once that is done.
+func migrateCommentsHandler(c context.Context, w http.ResponseWriter, r *http.Request) {
+	// App Engine strips this header from requests that don't come from cron.
+	if r.Header.Get("X-Appengine-Cron") != "true" && !requireAdmin(c, w, r) {
+		return
+	}
+	if loadConfig(c).CommentsMigrated {
+		fmt.Fprintln(w, "Comments are already migrated")
+		return
+	}
+	migrated := migrateComments(c)
+	fmt.Fprintf(w, "Migrated %d comments\n", migrated)
+}
+
+// migratePostsHandler is run by cron to index the trashed property of posts
+// stored before the trash existed. It does nothing once that is done.
+func migratePostsHandler(c context.Context, w http.ResponseWriter, r *http.Request) {
+	// App Engine strips this header from requests that don't come from cron.
+	if r.Header.Get("X-Appengine-Cron") != "true" && !requireAdmin(c, w, r) {
+		return
+	}
+	if loadConfig(c).PostsMigrated {
+		fmt.Fprintln(w, "Posts are already migrated")
+		return
+	}
+	migrated := migratePosts(c)
+	fmt.Fprintf(w, "Migrated %d posts\n", migrated)
+}
+
+// rerenderPostsHandler is run by cron to store the HTML of posts and comments
+// rendered with an outdated markdown configuration. It does nothing once all
+// are current.
+func rerenderPostsHandler(c context.Context, w http.ResponseWriter, r *http.Request) {
+	// App Engine strips this header from requests that don't come from cron.
+	if r.Header.Get("X-Appengine-Cron") != "true" && !requireAdmin(c, w, r) {
+		return
+	}
+	if loadConfig(c).RenderVersion == markdownVersion {
+		fmt.Fprintln(w, "Posts and comments are already rendered")
+		return
+	}
+	rendered := rerenderPosts(c)
+	fmt.Fprintf(w, "Rendered %d posts and comments\n", rendered)
+}
+
+func moderateComments(c context.Context, w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(c, w, r) {
+		return
+	}
+
+	if r.Method == "POST" {
+		if !requireFormToken(c, w, r) {
+			return
+		}
+		action := strings.ToLower(r.PostForm.Get("action"))
+		for _, encoded := range r.PostForm["key"] {
+			key, err := datastore.NewKeyEncoded(encoded)
+			if err != nil {
+				panic(err)
+			}
+			if err := moderateComment(c, key, action); err != nil {
+				panic(err)
+			}
+			logging.Infof(c, "Comment %s: %s", key, action)
+		}
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+
+	page, err := strconv.Atoi(mux.Vars(r)["page"])
+	if err != nil {
+		page = 1
+	}
+	count := getPendingCommentPageCount(c)
+	if page > count {
+		panic(datastore.ErrNoSuchEntity)
+	}
+	comments := loadPendingComments(c, page)
+	renderModerationQueue(w, comments, page, count, sessionFormToken(c, w, r))
+}
+
+func manageTrash(c context.Context, w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(c, w, r) {
+		return
+	}
+
+	if r.Method == "POST" {
+		if !requireFormToken(c, w, r) {
+			return
+		}
+		p := &Post{Slug: createSlug(c, r.PostForm.Get("slug"))}
+		if err := datastore.Get(c, p); err != nil {
+			panic(err)
+		}
+		switch action := r.PostForm.Get("action"); action {
+		case "Restore":
+			restorePost(c, p)
+		case "Delete permanently":
+			purgePost(c, p)
+		default:
+			panic(fmt.Errorf("unknown trash action %q", action))
+		}
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+
+	renderTrash(w, loadTrashedPosts(c), sessionFormToken(c, w, r))
+}
+
+func editSettings(c context.Context, w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(c, w, r) {
+		return
+	}
+
+	// Checked before loading the config, which might store a new form secret.
+	if r.Method == "POST" && !requireFormToken(c, w, r) {
+		return
+	}
+	config := loadConfig(c)
+	if r.Method == "POST" {
+		switch r.PostForm.Get("action") {
+		case "new_app_password":
+			// Shown only once, it cannot be recovered from its hash.
+			renderSettings(w, config, newAppPassword(c, config), sessionFormToken(c, w, r))
+			return
+		case "revoke_app_password":
+			revokeAppPassword(c, config)
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+			return
+		}
+		config.FeedSummaries = r.PostForm.Get("FeedSummaries") == "true"
+		config.FeedTitle = strings.TrimSpace(r.PostForm.Get("FeedTitle"))
+		config.FeedAuthor = strings.TrimSpace(r.PostForm.Get("FeedAuthor"))
+		if baseURL := strings.TrimSpace(r.PostForm.Get("BaseURL")); baseURL != "" {
+			u, err := url.Parse(baseURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				http.Error(w, "Invalid base URL", http.StatusBadRequest)
+				return
+			}
+			config.BaseURL = u.Scheme + "://" + u.Host
+		} else {
+			config.BaseURL = ""
+		}
+		if tagAuthority := strings.ToLower(strings.TrimSpace(r.PostForm.Get("TagAuthority"))); tagAuthority != "" {
+			if !tagAuthorityRE.MatchString(tagAuthority) {
+				http.Error(w, "Invalid tag authority", http.StatusBadRequest)
+				return
+			}
+			config.TagAuthority = tagAuthority
+		} else if config.BaseURL != "" {
+			u, _ := url.Parse(config.BaseURL)
+			config.TagAuthority = defaultTagAuthority(c, u.Hostname())
+		} else {
+			config.TagAuthority = ""
+		}
+		storeConfig(c, config)
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+
+	renderSettings(w, config, "", sessionFormToken(c, w, r))
+}
+
+// mediaTypes are the types of uploaded media that are served as they are.
+// Anything else, e.g. HTML, could run scripts on the blog's domain and is only
+// served for download.
+var mediaTypes = []string{"image/", "audio/", "video/", "application/pdf"}
+
+func serveMedia(c context.Context, w http.ResponseWriter, r *http.Request) {
+	m := loadMedia(c, mux.Vars(r)["name"])
+	contentType := "application/octet-stream"
+	for _, prefix := range mediaTypes {
+		if strings.HasPrefix(m.ContentType, prefix) && m.ContentType != "image/svg+xml" {
+			contentType = m.ContentType
+		}
+	}
+	if contentType == "application/octet-stream" {
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Names of media never change their content.
+	w.Header().Set("Cache-Control", "public, max-age=31536000")
+	http.ServeContent(w, r, "", m.Created, bytes.NewReader(m.Data))
+}
+
+func postRevisions(c context.Context, w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	p, _ := loadPost(c, mux.Vars(r)["slug"])
+
+	if r.Method == "POST" {
+		if !requireFormToken(c, w, r) {
+			return
+		}
+		rev := loadRevision(c, p, parseRevisionID(r.PostForm.Get("revision")))
+		restoreRevision(c, p, rev)
+		logging.Infof(c, "Restored %s to revision %s", p.Slug, rev.Key)
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+
+	revisions := loadRevisions(c, p)
+	var from, to *Revision
+	query := r.URL.Query()
+	if query.Get("from") != "" && query.Get("to") != "" {
+		from = loadRevision(c, p, parseRevisionID(query.Get("from")))
+		to = loadRevision(c, p, parseRevisionID(query.Get("to")))
+	} else if len(revisions) >= 2 {
+		// Default to the most recent change.
+		from, to = &revisions[1], &revisions[0]
+	}
+	renderRevisions(w, p, revisions, from, to, sessionFormToken(c, w, r))
+}
+
+// previewPost shows a post, usually a draft, to anyone with a valid preview link.
+func previewPost(c context.Context, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	post := loadPreviewPost(c, vars["slug"], vars["token"])
+	// Preview links are secret, keep them out of search engines.
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	renderPreview(w, post)
+}
+
+// managePreviews creates and revokes preview links for a post.
+func managePreviews(c context.Context, w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(c, w, r) {
+		return
+	}
+	if !requireFormToken(c, w, r) {
+		return
+	}
+	p, _ := loadPost(c, mux.Vars(r)["slug"])
+	if revoke := r.PostForm.Get("revoke"); revoke != "" {
+		id, err := strconv.ParseInt(revoke, 10, 64)
+		if err != nil {
+			panic(datastore.ErrNoSuchEntity)
+		}
+		revokePreviewLink(c, p, id)
+	} else {
+		days, err := strconv.Atoi(r.PostForm.Get("days"))
+		if err != nil || days < 1 || days > maxPreviewDays {
+			http.Error(w, "Invalid number of days", http.StatusBadRequest)
+			return
+		}
+		createPreviewLink(c, p, time.Duration(days)*24*time.Hour)
+	}
+	http.Redirect(w, r, string(p.EditUrl())+"#previews", http.StatusSeeOther)
+}
+
+// maxPreviewDays is the longest a preview link can be valid for.
+const maxPreviewDays = 90
+
+func parseRevisionID(s string) int64 {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		// Not a revision we know about.
+		panic(datastore.ErrNoSuchEntity)
+	}
+	return id
 }
@@ -1,14 +1,25 @@
 package blog
 
 import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/luci/gae/impl/memory"
+	"github.com/luci/gae/service/datastore"
+	"github.com/luci/gae/service/taskqueue"
+	"github.com/luci/gae/service/urlfetch"
 	"github.com/luci/gae/service/user"
 	"golang.org/x/net/context"
 
@@ -35,15 +46,25 @@ func (s *ServingTest) TearDownTest(c *C) {
 
 var _ = Suite(&ServingTest{})
 
-func makeRequest() *http.Request {
-	return &http.Request{
+func makeRequest(c context.Context) *http.Request {
+	return withFormToken(c, &http.Request{
 		Method: "POST",
 		URL:    &url.URL{Path: "/blog/new"},
 		PostForm: url.Values{
 			"Title": {"Hello"},
 			"Text":  {"Test Body Text"},
 		},
+	})
+}
+
+// withFormToken adds the session's token to a form posted by the admin.
+func withFormToken(c context.Context, r *http.Request) *http.Request {
+	if r.Header == nil {
+		r.Header = http.Header{}
 	}
+	r.AddCookie(&http.Cookie{Name: formNonceCookie, Value: "test-nonce"})
+	r.PostForm.Set("form_token", formToken(c, "test-nonce"))
+	return r
 }
 
 func (s *ServingTest) TestIndexPage(c *C) {
@@ -59,6 +80,7 @@ func (s *ServingTest) TestIndexPage(c *C) {
 	body := rw.Body.String()
 	c.Check(strings.Contains(body, "My post #15"), Equals, true)
 	c.Check(strings.Contains(body, "My post #5"), Equals, false)
+	c.Check(strings.Contains(body, `<link rel="canonical" href="/blog/" />`), Equals, true)
 }
 
 func (s *ServingTest) TestEditPost_Render(c *C) {
@@ -73,7 +95,7 @@ func (s *ServingTest) TestEditPost_Render(c *C) {
 
 func (s *ServingTest) TestEditPost_Preview(c *C) {
 	rw := httptest.NewRecorder()
-	r := makeRequest()
+	r := makeRequest(s.ctx)
 	editPost(s.ctx, rw, r)
 
 	str := rw.Body.String()
@@ -84,7 +106,7 @@ func (s *ServingTest) TestEditPost_Preview(c *C) {
 func (s *ServingTest) TestEditPost_Create(c *C) {
 	t := time.Now()
 	rw := httptest.NewRecorder()
-	r := makeRequest()
+	r := makeRequest(s.ctx)
 	r.PostForm.Set("action", "Post")
 	editPost(s.ctx, rw, r)
 
@@ -101,3 +123,1483 @@ func (s *ServingTest) TestEditPost_Create(c *C) {
 	c.Check(p.Updated.After(t), Equals, true,
 		Commentf("Should be created after start: %s > %s", p.Updated, t))
 }
+
+func (s *ServingTest) TestCommentForm_Validate(c *C) {
+	form := &CommentForm{
+		Author:      " Jane ",
+		AuthorEmail: "jane@example.com",
+		AuthorUrl:   "example.com/jane",
+		Text:        "Nice post!",
+	}
+	c.Check(form.validate(), Equals, true)
+	c.Check(form.Author, Equals, "Jane")
+	c.Check(form.AuthorUrl, Equals, "http://example.com/jane")
+
+	form = &CommentForm{
+		AuthorEmail: "Jane <jane@example.com>",
+		AuthorUrl:   "javascript://alert(1)",
+	}
+	c.Check(form.validate(), Equals, false)
+	c.Check(form.Errors["Author"], DeepEquals, []string{"required"})
+	c.Check(form.Errors["AuthorEmail"], HasLen, 1)
+	c.Check(form.Errors["AuthorUrl"], HasLen, 1)
+	c.Check(form.Errors["Text"], DeepEquals, []string{"required"})
+}
+
+func makeCommentRequest(slug string, form url.Values) *http.Request {
+	r := &http.Request{
+		Method:   "POST",
+		URL:      &url.URL{Path: "/blog/2014/01/01/" + slug + "/comment"},
+		PostForm: form,
+	}
+	return mux.SetURLVars(r, map[string]string{"ymd": "2014/01/01", "slug": slug})
+}
+
+func (s *ServingTest) TestAddComment_Stores(c *C) {
+	p, _ := testPost()
+	p.NumComments = 0
+	storePost(s.ctx, p)
+
+	rw := httptest.NewRecorder()
+	addComment(s.ctx, rw, makeCommentRequest(p.Slug.StringID(), url.Values{
+		"Author":      {"Jane"},
+		"AuthorEmail": {"jane@example.com"},
+		"Text":        {"Nice post!"},
+	}))
+	c.Check(rw.Code, Equals, http.StatusSeeOther)
+	c.Check(rw.Header().Get("Location"), Matches, ".*/hello-world/\\?comment=pending#comment_form")
+
+	_, comments := loadPost(s.ctx, p.Slug.StringID())
+	c.Assert(comments, HasLen, 1)
+	c.Check(comments[0].Author, Equals, "Jane")
+	c.Check(comments[0].Approved, Equals, false)
+}
+
+func (s *ServingTest) TestAddComment_Invalid(c *C) {
+	p, _ := testPost()
+	p.NumComments = 0
+	storePost(s.ctx, p)
+
+	rw := httptest.NewRecorder()
+	addComment(s.ctx, rw, makeCommentRequest(p.Slug.StringID(), url.Values{
+		"Author": {"Jane"},
+		"Text":   {"Nice post!"},
+	}))
+	c.Check(rw.Code, Equals, http.StatusBadRequest)
+	c.Check(strings.Contains(rw.Body.String(), "field_errors"), Equals, true)
+
+	_, comments := loadPost(s.ctx, p.Slug.StringID())
+	c.Check(comments, HasLen, 0)
+}
+
+func (s *ServingTest) TestModerateComments(c *C) {
+	storeDevelopmentFixture(s.ctx)
+
+	rw := httptest.NewRecorder()
+	r := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/blog/admin/comments/"},
+	}
+	moderateComments(s.ctx, rw, r)
+	c.Check(rw.Code, Equals, http.StatusOK)
+	c.Check(strings.Contains(rw.Body.String(), "other comment"), Equals, true)
+
+	pending := loadPendingComments(s.ctx, 1)
+	c.Assert(pending, HasLen, 1)
+	rw = httptest.NewRecorder()
+	r = &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/blog/admin/comments/"},
+		PostForm: url.Values{
+			"action": {"Approve"},
+			"key":    {pending[0].Key.Encode()},
+		},
+	}
+	moderateComments(s.ctx, rw, withFormToken(s.ctx, r))
+	c.Check(rw.Code, Equals, http.StatusSeeOther)
+	c.Check(loadPendingComments(s.ctx, 1), HasLen, 0)
+}
+
+func (s *ServingTest) TestManageTrash(c *C) {
+	p, _ := testPost()
+	p.NumComments = 0
+	storePost(s.ctx, p)
+	trashPost(s.ctx, p)
+
+	rw := httptest.NewRecorder()
+	r := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/blog/admin/trash/"},
+	}
+	manageTrash(s.ctx, rw, r)
+	c.Check(rw.Code, Equals, http.StatusOK)
+	c.Check(strings.Contains(rw.Body.String(), "Hello World"), Equals, true)
+
+	rw = httptest.NewRecorder()
+	r = &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/blog/admin/trash/"},
+		PostForm: url.Values{
+			"action": {"Restore"},
+			"slug":   {"hello-world"},
+		},
+	}
+	manageTrash(s.ctx, rw, r)
+	c.Check(rw.Code, Equals, http.StatusForbidden, Commentf("Posted without a token"))
+	c.Check(loadTrashedPosts(s.ctx), HasLen, 1)
+
+	rw = httptest.NewRecorder()
+	manageTrash(s.ctx, rw, withFormToken(s.ctx, r))
+	c.Check(rw.Code, Equals, http.StatusSeeOther)
+	c.Check(loadTrashedPosts(s.ctx), HasLen, 0)
+}
+
+func (s *ServingTest) TestFormToken(c *C) {
+	// Admin pages start a session and put its token into their forms.
+	rw := httptest.NewRecorder()
+	editSettings(s.ctx, rw, &http.Request{Method: "GET", URL: &url.URL{Path: "/blog/admin/settings"}})
+	c.Assert(rw.Code, Equals, http.StatusOK)
+	cookies := (&http.Response{Header: rw.Header()}).Cookies()
+	c.Assert(cookies, HasLen, 1)
+	c.Check(cookies[0].Name, Equals, formNonceCookie)
+	c.Check(cookies[0].HttpOnly, Equals, true)
+	match := regexp.MustCompile(`name="form_token" value="([\w-]+)"`).FindStringSubmatch(rw.Body.String())
+	c.Assert(match, HasLen, 2)
+
+	post := func(nonce, token string) int {
+		r := &http.Request{Method: "POST", URL: &url.URL{Path: "/blog/admin/settings"}, Header: http.Header{},
+			PostForm: url.Values{"action": {"new_app_password"}, "form_token": {token}}}
+		if nonce != "" {
+			r.AddCookie(&http.Cookie{Name: formNonceCookie, Value: nonce})
+		}
+		rw := httptest.NewRecorder()
+		editSettings(s.ctx, rw, r)
+		return rw.Code
+	}
+	c.Check(post("", match[1]), Equals, http.StatusForbidden)
+	c.Check(post("other-nonce", match[1]), Equals, http.StatusForbidden)
+	c.Check(post(cookies[0].Value, ""), Equals, http.StatusForbidden)
+	c.Check(len(loadConfig(s.ctx).AppPasswordHash), Equals, 0)
+
+	// Tokens are bound to the signed in admin.
+	user.GetTestable(s.ctx).Login("other@example.com", "", true)
+	c.Check(post(cookies[0].Value, match[1]), Equals, http.StatusForbidden)
+	user.GetTestable(s.ctx).Login("test@example.com", "", true)
+	c.Check(post(cookies[0].Value, match[1]), Equals, http.StatusOK)
+	c.Check(len(loadConfig(s.ctx).AppPasswordHash), Not(Equals), 0)
+
+	// A session keeps its token.
+	rw = httptest.NewRecorder()
+	r := &http.Request{Method: "GET", URL: &url.URL{Path: "/blog/admin/trash/"}, Header: http.Header{}}
+	r.AddCookie(cookies[0])
+	manageTrash(s.ctx, rw, r)
+	c.Check(rw.Header().Get("Set-Cookie"), Equals, "")
+}
+
+func (s *ServingTest) TestPostRevisions_Diff(c *C) {
+	p, _ := testPost()
+	storePost(s.ctx, p)
+	p.Text = "Edited content"
+	storePost(s.ctx, p)
+
+	rw := httptest.NewRecorder()
+	r := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/blog/2014/01/01/hello-world/edit/revisions"},
+	}
+	r = mux.SetURLVars(r, map[string]string{"ymd": "2014/01/01", "slug": "hello-world"})
+	postRevisions(s.ctx, rw, r)
+	c.Check(rw.Code, Equals, http.StatusOK)
+	body := rw.Body.String()
+	c.Check(strings.Contains(body, `<div class="diff_delete">- Test content</div>`), Equals, true)
+	c.Check(strings.Contains(body, `<div class="diff_insert">&#43; Edited content</div>`), Equals, true)
+}
+
+func (s *ServingTest) TestTagPage(c *C) {
+	p, _ := testPost()
+	p.Tags = []string{"testing"}
+	storePost(s.ctx, p)
+
+	rw := httptest.NewRecorder()
+	r := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/blog/tag/testing/"},
+	}
+	tagPage(s.ctx, rw, mux.SetURLVars(r, map[string]string{"tag": "testing"}))
+	c.Check(rw.Code, Equals, http.StatusOK)
+	body := rw.Body.String()
+	c.Check(strings.Contains(body, "Hello World"), Equals, true)
+	c.Check(strings.Contains(body, `href="/blog/tag/testing/" rel="tag"`), Equals, true)
+
+	rw = httptest.NewRecorder()
+	tagIndex(s.ctx, rw, &http.Request{Method: "GET", URL: &url.URL{Path: "/blog/tag/"}})
+	c.Check(strings.Contains(rw.Body.String(), "testing</a> (1)"), Equals, true)
+}
+
+func (s *ServingTest) TestTagFeed(c *C) {
+	p, _ := testPost()
+	p.Tags = []string{"testing", "go"}
+	storePost(s.ctx, p)
+	storePost(s.ctx, &Post{Title: "Untagged"})
+
+	rw := httptest.NewRecorder()
+	r := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/blog/tag/testing/feed/"},
+		Host:   "example.com",
+	}
+	feed(s.ctx, rw, mux.SetURLVars(r, map[string]string{"tag": "testing", "page": ""}))
+	c.Check(rw.Code, Equals, http.StatusOK)
+	body := rw.Body.String()
+	c.Check(strings.Contains(body, "Hello World"), Equals, true)
+	c.Check(strings.Contains(body, "Untagged"), Equals, false)
+	c.Check(strings.Contains(body, `<link rel="self" href="http://example.com/blog/tag/testing/feed/"/>`), Equals, true)
+	c.Check(strings.Contains(body, `<category term="go"/>`), Equals, true)
+}
+
+func (s *ServingTest) TestArchivePage(c *C) {
+	p, _ := testPost()
+	storePost(s.ctx, p)
+	ymd := strings.Split(p.Created.Format("2006/01/02"), "/")
+
+	rw := httptest.NewRecorder()
+	r := &http.Request{Method: "GET", URL: &url.URL{Path: "/blog/" + ymd[0] + "/" + ymd[1] + "/"}}
+	archivePage(s.ctx, rw, mux.SetURLVars(r, map[string]string{"year": ymd[0], "month": ymd[1]}))
+	c.Check(rw.Code, Equals, http.StatusOK)
+	c.Check(strings.Contains(rw.Body.String(), "Hello World"), Equals, true)
+
+	rw = httptest.NewRecorder()
+	archiveIndex(s.ctx, rw, &http.Request{Method: "GET", URL: &url.URL{Path: "/blog/archive/"}})
+	c.Check(strings.Contains(rw.Body.String(), `href="/blog/`+ymd[0]+"/"+ymd[1]+`/"`), Equals, true)
+
+	c.Check(func() {
+		archivePage(s.ctx, httptest.NewRecorder(), mux.SetURLVars(r, map[string]string{"year": "2014", "month": "13"}))
+	}, PanicMatches, "datastore: no such entity")
+}
+
+func (s *ServingTest) TestShowPost_Canonical(c *C) {
+	p, _ := testPost()
+	storePost(s.ctx, p)
+	canonical := p.Route(routeShowPost).String()
+
+	rw := httptest.NewRecorder()
+	r := &http.Request{Method: "GET", URL: &url.URL{Path: "/blog/1999/1/1/hello-world/", RawQuery: "comment=pending"}}
+	showPost(s.ctx, rw, mux.SetURLVars(r, map[string]string{"ymd": "1999/1/1", "slug": "hello-world"}))
+	c.Check(rw.Code, Equals, http.StatusMovedPermanently)
+	c.Check(rw.Header().Get("Location"), Equals, canonical+"?comment=pending")
+
+	rw = httptest.NewRecorder()
+	r = &http.Request{Method: "GET", URL: &url.URL{Path: canonical}}
+	showPost(s.ctx, rw, mux.SetURLVars(r, map[string]string{
+		"ymd": p.Created.Format("2006/01/02"), "slug": "hello-world"}))
+	c.Check(rw.Code, Equals, http.StatusOK)
+	c.Check(strings.Contains(rw.Body.String(), `<link rel="canonical" href="`+canonical+`" />`), Equals, true)
+}
+
+func (s *ServingTest) TestEditPost_RenameSlug(c *C) {
+	p, _ := testPost()
+	storePost(s.ctx, p)
+	ymd := p.Created.Format("2006/01/02")
+
+	r := makeRequest(s.ctx)
+	r.PostForm.Set("action", "Post")
+	r.PostForm.Set("Slug", "Hello Gophers")
+	rw := httptest.NewRecorder()
+	editPost(s.ctx, rw, mux.SetURLVars(r, map[string]string{"ymd": ymd, "slug": "hello-world"}))
+	c.Check(rw.Code, Equals, http.StatusSeeOther)
+	c.Check(rw.Header().Get("Location"), Matches, ".*/hello-gophers/")
+
+	rw = httptest.NewRecorder()
+	r = &http.Request{Method: "GET", URL: &url.URL{Path: "/blog/" + ymd + "/hello-world/"}}
+	showPost(s.ctx, rw, mux.SetURLVars(r, map[string]string{"ymd": ymd, "slug": "hello-world"}))
+	c.Check(rw.Code, Equals, http.StatusMovedPermanently)
+	c.Check(rw.Header().Get("Location"), Matches, ".*/"+ymd+"/hello-gophers/")
+
+	// Taken slugs are a form error, and the edit isn't stored.
+	other := &Post{Title: "Taken"}
+	storePost(s.ctx, other)
+	r = makeRequest(s.ctx)
+	r.PostForm.Set("action", "Post")
+	r.PostForm.Set("Text", "Edited text")
+	r.PostForm.Set("Slug", "taken")
+	rw = httptest.NewRecorder()
+	editPost(s.ctx, rw, mux.SetURLVars(r, map[string]string{"ymd": ymd, "slug": "hello-gophers"}))
+	c.Check(rw.Code, Equals, http.StatusBadRequest)
+	body := rw.Body.String()
+	c.Check(strings.Contains(body, "is taken by another post"), Equals, true)
+	c.Check(strings.Contains(body, `value="taken"`), Equals, true)
+	renamed, _ := loadPost(s.ctx, "hello-gophers")
+	c.Check(renamed.Text, Not(Equals), "Edited text")
+
+	// A new post can take the old slug.
+	r = makeRequest(s.ctx)
+	r.PostForm.Set("action", "Post")
+	r.PostForm.Set("Slug", "hello-world")
+	rw = httptest.NewRecorder()
+	editPost(s.ctx, rw, r)
+	c.Assert(rw.Code, Equals, http.StatusSeeOther)
+	c.Check(rw.Header().Get("Location"), Matches, ".*/hello-world/")
+	reused, _ := loadPost(s.ctx, "hello-world")
+	rw = httptest.NewRecorder()
+	r = &http.Request{Method: "GET", URL: &url.URL{Path: string(reused.Url())}}
+	showPost(s.ctx, rw, mux.SetURLVars(r, map[string]string{
+		"ymd": reused.Created.Format("2006/01/02"), "slug": "hello-world"}))
+	c.Check(rw.Code, Equals, http.StatusOK)
+}
+
+func (s *ServingTest) TestEditPost_InvalidPublishAt(c *C) {
+	r := makeRequest(s.ctx)
+	r.PostForm.Set("action", "Post")
+	r.PostForm.Set("PublishAt", "tomorrow")
+	rw := httptest.NewRecorder()
+	editPost(s.ctx, rw, r)
+	c.Check(rw.Code, Equals, http.StatusBadRequest)
+	body := rw.Body.String()
+	c.Check(strings.Contains(body, "not a valid date and time"), Equals, true)
+	c.Check(strings.Contains(body, "Test Body Text"), Equals, true)
+	c.Check(newestPosts(s.ctx, allPosts), HasLen, 0)
+}
+
+func (s *ServingTest) TestEditPost_NewPostSlug(c *C) {
+	r := makeRequest(s.ctx)
+	r.PostForm.Set("action", "Post")
+	r.PostForm.Set("Slug", "Hello Gophers")
+	rw := httptest.NewRecorder()
+	editPost(s.ctx, rw, r)
+	c.Check(rw.Code, Equals, http.StatusSeeOther)
+	c.Check(rw.Header().Get("Location"), Matches, ".*/hello-gophers/")
+
+	// The post is stored under the slug right away, so nothing redirects.
+	c.Check(loadRedirectedPost(s.ctx, "hello"), IsNil)
+	c.Check(func() { loadPost(s.ctx, "hello") }, PanicMatches, "datastore: no such entity")
+	p, _ := loadPost(s.ctx, "hello-gophers")
+	c.Check(loadRevisions(s.ctx, p), HasLen, 1)
+
+	// Taken slugs fall back to the title.
+	r = makeRequest(s.ctx)
+	r.PostForm.Set("action", "Post")
+	r.PostForm.Set("Slug", "hello-gophers")
+	rw = httptest.NewRecorder()
+	editPost(s.ctx, rw, r)
+	c.Check(rw.Header().Get("Location"), Matches, ".*/hello/")
+}
+
+func (s *ServingTest) TestEditPost_Schedule(c *C) {
+	publishAt := time.Now().UTC().Add(24 * time.Hour).Format(publishAtFormat)
+	r := makeRequest(s.ctx)
+	r.PostForm.Set("action", "Post")
+	r.PostForm.Set("PublishAt", publishAt)
+	editPost(s.ctx, httptest.NewRecorder(), r)
+
+	posts := newestPosts(s.ctx, allPosts)
+	c.Assert(posts, HasLen, 1)
+	c.Check(posts[0].Scheduled, Equals, true)
+	c.Check(posts[0].Draft, Equals, true)
+	c.Check(posts[0].PublishAt.Format(publishAtFormat), Equals, publishAt)
+
+	// Times in the past do not schedule the post.
+	_, past, err := parsePublishAt("2014-01-01T10:00")
+	c.Check(err, IsNil)
+	c.Check(past.IsZero(), Equals, true)
+
+	rw := httptest.NewRecorder()
+	r = &http.Request{Method: "GET", URL: &url.URL{Path: "/blog/admin/publish_scheduled"},
+		Header: http.Header{"X-Appengine-Cron": {"true"}}}
+	publishScheduled(s.ctx, rw, r)
+	c.Check(rw.Body.String(), Equals, "Published 0 posts\n")
+}
+
+func (s *ServingTest) TestPreviewLinks(c *C) {
+	p, _ := testPost()
+	p.Draft = true
+	storePost(s.ctx, p)
+	vars := map[string]string{"ymd": p.Created.Format("2006/01/02"), "slug": p.Slug.StringID()}
+
+	r := &http.Request{Method: "POST", URL: &url.URL{Path: "/blog/edit/previews"},
+		PostForm: url.Values{"days": {"7"}}}
+	rw := httptest.NewRecorder()
+	managePreviews(s.ctx, rw, mux.SetURLVars(withFormToken(s.ctx, r), vars))
+	c.Check(rw.Code, Equals, http.StatusSeeOther)
+	links := loadPreviewLinks(s.ctx, p)
+	c.Assert(links, HasLen, 1)
+
+	preview := func(token string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		r := &http.Request{Method: "GET", URL: &url.URL{Path: "/blog/preview/" + token}}
+		previewVars := map[string]string{"token": token}
+		for k, v := range vars {
+			previewVars[k] = v
+		}
+		appEngineHandler(func(_ context.Context, w http.ResponseWriter, r *http.Request) {
+			previewPost(s.ctx, w, r)
+		}).ServeHTTP(rw, mux.SetURLVars(r, previewVars))
+		return rw
+	}
+
+	// Readers that are not admins can see the draft.
+	user.GetTestable(s.ctx).Logout()
+	url := string(links[0].Url)
+	token := url[strings.LastIndex(url, "/")+1:]
+	rw = preview(token)
+	c.Check(rw.Code, Equals, http.StatusOK)
+	c.Check(rw.Header().Get("X-Robots-Tag"), Equals, "noindex, nofollow")
+	body := rw.Body.String()
+	c.Check(strings.Contains(body, "Hello World"), Equals, true)
+	c.Check(strings.Contains(body, `class="preview_banner"`), Equals, true)
+	c.Check(strings.Contains(body, `<meta name="robots" content="noindex, nofollow">`), Equals, true)
+
+	// Tampered tokens and revoked tokens don't work.
+	c.Check(preview(token[:len(token)-2]+"xx").Code, Equals, http.StatusNotFound)
+	c.Check(preview("1.99999999999.abc").Code, Equals, http.StatusNotFound)
+	revokePreviewLink(s.ctx, p, links[0].Key.IntID())
+	c.Check(preview(token).Code, Equals, http.StatusNotFound)
+}
+
+func (s *ServingTest) TestSummaries(c *C) {
+	p, _ := testPost()
+	p.Text = "The intro.\n\n<!--more-->\n\nThe rest of the post."
+	storePost(s.ctx, p)
+
+	rw := httptest.NewRecorder()
+	indexPage(s.ctx, rw, &http.Request{Method: "GET", URL: &url.URL{Path: "/blog/"}})
+	body := rw.Body.String()
+	c.Check(strings.Contains(body, "The intro."), Equals, true)
+	c.Check(strings.Contains(body, "The rest of the post."), Equals, false)
+	c.Check(strings.Contains(body, "Continue reading"), Equals, true)
+
+	getFeed := func() string {
+		rw := httptest.NewRecorder()
+		r := &http.Request{Method: "GET", URL: &url.URL{Path: "/blog/feed/"}, Host: "example.com"}
+		feed(s.ctx, rw, r)
+		return rw.Body.String()
+	}
+	body = getFeed()
+	c.Check(strings.Contains(body, "<content"), Equals, true)
+	c.Check(strings.Contains(body, "The rest of the post."), Equals, true)
+
+	rw = httptest.NewRecorder()
+	editSettings(s.ctx, rw, withFormToken(s.ctx, &http.Request{Method: "POST", URL: &url.URL{Path: "/blog/admin/settings"},
+		PostForm: url.Values{"FeedSummaries": {"true"}}}))
+	c.Check(rw.Code, Equals, http.StatusSeeOther)
+	body = getFeed()
+	c.Check(strings.Contains(body, "<summary"), Equals, true)
+	c.Check(strings.Contains(body, "<content"), Equals, false)
+	c.Check(strings.Contains(body, "The rest of the post."), Equals, false)
+}
+
+const benchmarkText = `A paragraph with *emphasis*, **strong text**, a [link](http://example.com/)
+and some "quotes" -- enough to keep the smartypants renderer busy.
+
+* A list item
+* Another item with ` + "`code`" + `
+* A third item
+
+` + "```" + `
+func main() {
+	fmt.Println("Hello World")
+}
+` + "```" + `
+
+| Column | Other column |
+|--------|--------------|
+| 1      | 2            |
+
+`
+
+func benchmarkRenderPosts(b *testing.B, stored bool) {
+	ctx := memory.Use(context.Background())
+	posts := make([]Post, postsPerPage)
+	for i := range posts {
+		posts[i] = Post{
+			Slug:       datastore.NewKey(ctx, PostEntity, fmt.Sprint("post-", i), 0, nil),
+			Title:      fmt.Sprint("Post ", i),
+			Text:       strings.Repeat(benchmarkText, 5),
+			Timestamps: Timestamps{Created: created, Updated: updated},
+		}
+		if stored {
+			posts[i].render()
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		renderPosts(ioutil.Discard, posts, allPosts, Navigation{})
+	}
+}
+
+// Renders an index page using the HTML stored with the posts.
+func BenchmarkRenderPosts_Stored(b *testing.B) { benchmarkRenderPosts(b, true) }
+
+// Renders an index page, rendering the markdown of each post.
+func BenchmarkRenderPosts_Markdown(b *testing.B) { benchmarkRenderPosts(b, false) }
+
+func (s *ServingTest) TestIndexPage_Cursors(c *C) {
+	storeDevelopmentFixture(s.ctx)
+
+	get := func(path, query string, vars map[string]string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		r := &http.Request{Method: "GET", URL: &url.URL{Path: path, RawQuery: query}}
+		indexPage(s.ctx, rw, mux.SetURLVars(r, vars))
+		return rw
+	}
+
+	rw := get("/blog/", "", nil)
+	c.Check(rw.Code, Equals, http.StatusOK)
+	older := regexp.MustCompile(`href="/blog/\?(before=\d+&amp;slug=[\w-]+)" rel="next"`).FindStringSubmatch(rw.Body.String())
+	c.Assert(older, HasLen, 2)
+	query := strings.Replace(older[1], "&amp;", "&", -1)
+
+	rw = get("/blog/", query, nil)
+	c.Check(rw.Code, Equals, http.StatusOK)
+	body := rw.Body.String()
+	c.Check(strings.Contains(body, "My post #5"), Equals, true)
+	c.Check(strings.Contains(body, "My post #15"), Equals, false)
+	c.Check(strings.Contains(body, `<link rel="canonical" href="/blog/?`+older[1]+`" />`), Equals, true)
+	c.Check(strings.Contains(body, `rel="prev"`), Equals, true)
+
+	// Numbered pages redirect to their cursor.
+	rw = get("/blog/2/", "", map[string]string{"page": "2"})
+	c.Check(rw.Code, Equals, http.StatusMovedPermanently)
+	c.Check(rw.Header().Get("Location"), Equals, "/blog/?"+query)
+	rw = get("/blog/1/", "", map[string]string{"page": "1"})
+	c.Check(rw.Header().Get("Location"), Equals, "/blog/")
+
+	c.Check(get("/blog/", "before=foo", nil).Code, Equals, http.StatusBadRequest)
+}
+
+func (s *ServingTest) TestConditionalGet(c *C) {
+	p, _ := testPost()
+	p.NumComments = 0
+	// Last-Modified has a resolution of seconds.
+	p.Updated = p.Updated.Add(-time.Minute)
+	storePost(s.ctx, p)
+	path := p.Route(routeShowPost).String()
+	vars := map[string]string{"ymd": p.Created.Format("2006/01/02"), "slug": "hello-world"}
+
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		r := &http.Request{Method: "GET", URL: &url.URL{Path: path}, Header: header}
+		showPost(s.ctx, rw, mux.SetURLVars(r, vars))
+		return rw
+	}
+
+	rw := get(http.Header{})
+	c.Check(rw.Code, Equals, http.StatusOK)
+	etag := rw.Header().Get("ETag")
+	c.Check(etag, Matches, `"[\w-]+"`)
+	lastModified := rw.Header().Get("Last-Modified")
+	c.Check(lastModified, Equals, p.Updated.UTC().Format(http.TimeFormat))
+	c.Check(rw.Header().Get("Cache-Control"), Equals, "private, no-store")
+
+	rw = get(http.Header{"If-None-Match": {etag}})
+	c.Check(rw.Code, Equals, http.StatusNotModified)
+	c.Check(rw.Body.Len(), Equals, 0)
+	c.Check(get(http.Header{"If-None-Match": {`"stale"`}}).Code, Equals, http.StatusOK)
+	c.Check(get(http.Header{"If-Modified-Since": {lastModified}}).Code, Equals, http.StatusNotModified)
+
+	// Anonymous readers get cacheable responses.
+	user.GetTestable(s.ctx).Logout()
+	rw = get(http.Header{})
+	c.Check(rw.Header().Get("Cache-Control"), Equals, "public, no-cache")
+
+	// A new comment changes the page.
+	comment := &Comment{Author: "Reader", Text: "Nice.", Approved: true}
+	storeComment(s.ctx, p, comment)
+	c.Check(get(http.Header{"If-None-Match": {etag}}).Code, Equals, http.StatusOK)
+	c.Check(get(http.Header{"If-Modified-Since": {lastModified}}).Code, Equals, http.StatusOK)
+
+	// Editors using the app password get uncached responses, too.
+	rw = httptest.NewRecorder()
+	r := &http.Request{Method: "GET", URL: &url.URL{Path: path}}
+	showPost(withAppPassword(s.ctx), rw, mux.SetURLVars(r, vars))
+	c.Check(rw.Header().Get("Cache-Control"), Equals, "private, no-store")
+}
+
+func (s *ServingTest) TestConditionalGet_ListingComments(c *C) {
+	p, _ := testPost()
+	p.NumComments = 0
+	storePost(s.ctx, p)
+	comment := &Comment{Author: "Reader", Text: "Nice."}
+	c.Assert(storeComment(s.ctx, p, comment), IsNil)
+	// Last-Modified has a resolution of seconds.
+	backdatePostsChanged(c, s.ctx)
+	user.GetTestable(s.ctx).Logout()
+
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		indexPage(s.ctx, rw, &http.Request{Method: "GET", URL: &url.URL{Path: "/blog/"}, Header: header})
+		return rw
+	}
+	lastModified := get(http.Header{}).Header().Get("Last-Modified")
+	c.Check(get(http.Header{"If-Modified-Since": {lastModified}}).Code, Equals, http.StatusNotModified)
+
+	// Approving the comment changes the listing's comment count.
+	c.Assert(moderateComment(s.ctx, comment.Key, moderationApprove), IsNil)
+	c.Check(get(http.Header{"If-Modified-Since": {lastModified}}).Code, Equals, http.StatusOK)
+
+	// So does moving a post to the trash, which leaves older posts listed.
+	backdatePostsChanged(c, s.ctx)
+	lastModified = get(http.Header{}).Header().Get("Last-Modified")
+	c.Check(get(http.Header{"If-Modified-Since": {lastModified}}).Code, Equals, http.StatusNotModified)
+	trashPost(s.ctx, p)
+	c.Check(get(http.Header{"If-Modified-Since": {lastModified}}).Code, Equals, http.StatusOK)
+}
+
+// atomFeed is the subset of RFC 4287 that validateAtom checks.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Base    string      `xml:"http://www.w3.org/XML/1998/namespace base,attr"`
+	ID      []string    `xml:"id"`
+	Title   []string    `xml:"title"`
+	Updated []string    `xml:"updated"`
+	Authors []atomNames `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []struct {
+		ID        []string    `xml:"id"`
+		Title     []string    `xml:"title"`
+		Updated   []string    `xml:"updated"`
+		Published []string    `xml:"published"`
+		Authors   []atomNames `xml:"author"`
+		Links     []atomLink  `xml:"link"`
+		Content   []atomText  `xml:"content"`
+		Summary   []atomText  `xml:"summary"`
+	} `xml:"entry"`
+}
+
+type atomNames struct {
+	Name []string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+}
+
+// validateAtom checks body against the rules of the Atom format for feeds
+// and entries: cardinality of the required elements, absolute IRIs for IDs
+// and links, and RFC 3339 dates.
+func validateAtom(c *C, body string) *atomFeed {
+	c.Assert(strings.HasPrefix(body, xml.Header), Equals, true)
+	feed := &atomFeed{}
+	c.Assert(xml.Unmarshal([]byte(body), feed), IsNil)
+
+	absolute := func(iri string) {
+		u, err := url.Parse(iri)
+		c.Check(err, IsNil)
+		c.Check(u.IsAbs(), Equals, true, Commentf("relative IRI %q", iri))
+	}
+	date := func(dates []string) {
+		for _, d := range dates {
+			_, err := time.Parse(time.RFC3339, d)
+			c.Check(err, IsNil)
+		}
+	}
+	links := func(links []atomLink) {
+		alternates := make(map[string]bool)
+		for _, l := range links {
+			absolute(l.Href)
+			if l.Rel == "alternate" {
+				c.Check(alternates[l.Href], Equals, false)
+				alternates[l.Href] = true
+			}
+		}
+	}
+
+	absolute(feed.Base)
+	c.Check(feed.ID, HasLen, 1)
+	c.Check(feed.Title, HasLen, 1)
+	c.Check(feed.Updated, HasLen, 1)
+	for _, id := range feed.ID {
+		absolute(id)
+	}
+	date(feed.Updated)
+	links(feed.Links)
+	self := 0
+	for _, l := range feed.Links {
+		if l.Rel == "self" {
+			self++
+		}
+	}
+	c.Check(self, Equals, 1)
+	for _, a := range feed.Authors {
+		c.Check(a.Name, HasLen, 1)
+	}
+	if len(feed.Authors) == 0 {
+		// Without a feed author, every entry needs one.
+		for _, e := range feed.Entries {
+			c.Check(e.Authors, Not(HasLen), 0)
+		}
+	}
+
+	ids := make(map[string]bool)
+	for _, e := range feed.Entries {
+		c.Check(e.ID, HasLen, 1)
+		c.Check(e.Title, HasLen, 1)
+		c.Check(e.Updated, HasLen, 1)
+		c.Check(len(e.Published) <= 1, Equals, true)
+		for _, id := range e.ID {
+			absolute(id)
+			c.Check(ids[id], Equals, false, Commentf("duplicate entry ID %q", id))
+			ids[id] = true
+		}
+		date(e.Updated)
+		date(e.Published)
+		links(e.Links)
+		// Content is html, and either the full text or a summary.
+		c.Check(len(e.Content)+len(e.Summary) > 0, Equals, true)
+		c.Check(len(e.Content) <= 1 && len(e.Summary) <= 1, Equals, true)
+		for _, t := range append(e.Content, e.Summary...) {
+			c.Check(t.Type, Equals, "html")
+		}
+	}
+	return feed
+}
+
+func (s *ServingTest) TestFeed_Atom(c *C) {
+	storeDevelopmentFixture(s.ctx)
+	get := func(host, query string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		r := &http.Request{Method: "GET", URL: &url.URL{Path: "/blog/feed/", RawQuery: query}, Host: host}
+		feed(s.ctx, rw, r)
+		c.Assert(rw.Code, Equals, http.StatusOK)
+		return rw
+	}
+
+	rw := get("example.com:8080", "")
+	c.Check(rw.Header().Get("Content-Type"), Equals, "application/atom+xml; charset=utf-8")
+	first := validateAtom(c, rw.Body.String())
+	c.Check(first.Base, Equals, "http://example.com:8080/blog/")
+	c.Check(first.Entries, Not(HasLen), 0)
+	c.Check(first.ID[0], Matches, `tag:example\.com,\d{4}-\d{2}-\d{2}:feed`)
+	c.Check(first.Entries[0].ID[0], Matches, `tag:example\.com,\d{4}-\d{2}-\d{2}:post/.+`)
+	c.Check(first.Entries[0].Links[0].Href, Matches, `http://example\.com:8080/blog/\d{4}/.+`)
+	var next string
+	for _, l := range first.Links {
+		if l.Rel == "next" {
+			next = l.Href
+		}
+	}
+	c.Assert(next, Matches, `http://example\.com:8080/blog/feed/\?before=\d+&slug=[\w-]+`)
+	u, _ := url.Parse(next)
+	validateAtom(c, get("example.com:8080", u.RawQuery).Body.String())
+
+	// Without a base URL, the requested host is not stored as the authority.
+	c.Check(loadConfig(s.ctx).TagAuthority, Equals, "")
+	spoofed := validateAtom(c, get("evil.example.net", "").Body.String())
+	c.Check(spoofed.ID[0], Matches, `tag:evil\.example\.net,.*`)
+	c.Check(validateAtom(c, get("example.com:8080", "").Body.String()).ID, DeepEquals, first.ID)
+
+	// Configuring the host that served the feed keeps its IDs, whether the
+	// authority is stored on first use or by the settings form.
+	config := loadConfig(s.ctx)
+	config.BaseURL = "http://example.com"
+	storeConfig(s.ctx, config)
+	stored := validateAtom(c, get("other.example.net", "").Body.String())
+	c.Check(stored.ID, DeepEquals, first.ID)
+	c.Check(stored.Entries[0].ID, DeepEquals, first.Entries[0].ID)
+	c.Check(loadConfig(s.ctx).TagAuthority, Equals, strings.TrimSuffix(strings.TrimPrefix(first.ID[0], "tag:"), ":feed"))
+	set := func(form url.Values) int {
+		rw := httptest.NewRecorder()
+		editSettings(s.ctx, rw, withFormToken(s.ctx, &http.Request{Method: "POST", URL: &url.URL{Path: "/blog/admin/settings"},
+			PostForm: form}))
+		return rw.Code
+	}
+	c.Check(set(url.Values{"BaseURL": {"http://example.com"}}), Equals, http.StatusSeeOther)
+	c.Check(validateAtom(c, get("other.example.net", "").Body.String()).ID, DeepEquals, first.ID)
+
+	// The configured base URL sets the authority. IDs stay the same on other
+	// domains, links follow the configuration.
+	c.Check(set(url.Values{"BaseURL": {"https://Blog.Example.org"}}), Equals, http.StatusSeeOther)
+	configured := validateAtom(c, get("other.example.net", "").Body.String())
+	c.Check(configured.ID[0], Matches, `tag:blog\.example\.org,\d{4}-\d{2}-\d{2}:feed`)
+	authority := loadConfig(s.ctx).TagAuthority
+	c.Check(set(url.Values{"BaseURL": {"https://moved.example.org"}, "TagAuthority": {authority},
+		"FeedTitle": {"Example"}, "FeedAuthor": {"Jane Doe"}}), Equals, http.StatusSeeOther)
+	moved := validateAtom(c, get("other.example.net", "").Body.String())
+	c.Check(moved.Base, Equals, "https://moved.example.org/blog/")
+	c.Check(moved.ID, DeepEquals, configured.ID)
+	c.Check(moved.Title, DeepEquals, []string{"Example"})
+	c.Check(moved.Authors[0].Name, DeepEquals, []string{"Jane Doe"})
+
+	// The authority can be edited, but has to be valid.
+	c.Check(set(url.Values{"TagAuthority": {"example.com,2005"}}), Equals, http.StatusSeeOther)
+	c.Check(validateAtom(c, get("other.example.net", "").Body.String()).ID,
+		DeepEquals, []string{"tag:example.com,2005:feed"})
+	for _, invalid := range []string{"example.com", "example.com,05", "exa mple.com,2005", "http://x.com,2005"} {
+		c.Check(set(url.Values{"TagAuthority": {invalid}}), Equals, http.StatusBadRequest, Commentf(invalid))
+	}
+	c.Check(loadConfig(s.ctx).TagAuthority, Equals, "example.com,2005")
+}
+
+func (s *ServingTest) TestFeed_RSSAndJSON(c *C) {
+	storeDevelopmentFixture(s.ctx)
+	get := func(handler appEngineHandlerFunc, path, query string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		r := &http.Request{Method: "GET", URL: &url.URL{Path: path, RawQuery: query}, Host: "example.com"}
+		handler(s.ctx, rw, r)
+		c.Assert(rw.Code, Equals, http.StatusOK)
+		return rw
+	}
+
+	rw := get(rssFeed, "/blog/rss", "")
+	c.Check(rw.Header().Get("Content-Type"), Equals, "application/rss+xml; charset=utf-8")
+	var rss struct {
+		XMLName xml.Name `xml:"rss"`
+		Version string   `xml:"version,attr"`
+		Channel struct {
+			Title string     `xml:"title"`
+			Links []atomLink `xml:"http://www.w3.org/2005/Atom link"`
+			Items []struct {
+				Title   string `xml:"title"`
+				Link    string `xml:"link"`
+				GUID    string `xml:"guid"`
+				PubDate string `xml:"pubDate"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	c.Assert(xml.Unmarshal(rw.Body.Bytes(), &rss), IsNil)
+	c.Check(rss.Version, Equals, "2.0")
+	c.Check(rss.Channel.Title, Equals, "Martin Probst's blog")
+	c.Assert(rss.Channel.Items, Not(HasLen), 0)
+	item := rss.Channel.Items[0]
+	c.Check(item.Title, Not(Equals), "")
+	c.Check(item.Link, Matches, `http://example\.com/blog/\d{4}/.+`)
+	c.Check(item.GUID, Matches, `tag:example\.com,.+:post/.+`)
+	_, err := time.Parse(time.RFC1123Z, item.PubDate)
+	c.Check(err, IsNil)
+	var next string
+	for _, l := range rss.Channel.Links {
+		if l.Rel == "next" {
+			next = l.Href
+		}
+	}
+	c.Check(next, Matches, `http://example\.com/blog/rss\?before=\d+&slug=[\w-]+`)
+
+	rw = get(jsonFeed, "/blog/feed.json", "")
+	c.Check(rw.Header().Get("Content-Type"), Equals, "application/feed+json; charset=utf-8")
+	var feed JSONFeed
+	c.Assert(json.Unmarshal(rw.Body.Bytes(), &feed), IsNil)
+	c.Check(feed.Version, Equals, "https://jsonfeed.org/version/1.1")
+	c.Check(feed.FeedURL, Equals, "http://example.com/blog/feed.json")
+	c.Assert(feed.Items, Not(HasLen), 0)
+	c.Check(feed.Items[0].ID, Equals, item.GUID)
+	c.Check(feed.Items[0].URL, Equals, item.Link)
+	c.Assert(feed.NextURL, Matches, `http://example\.com/blog/feed\.json\?before=\d+&slug=[\w-]+`)
+
+	u, _ := url.Parse(feed.NextURL)
+	var older JSONFeed
+	c.Assert(json.Unmarshal(get(jsonFeed, "/blog/feed.json", u.RawQuery).Body.Bytes(), &older), IsNil)
+	c.Check(older.FeedURL, Equals, feed.NextURL)
+	c.Check(older.Items[0].ID, Not(Equals), feed.Items[0].ID)
+
+	rw = get(indexPage, "/blog/", "")
+	c.Check(strings.Contains(rw.Body.String(), `type="application/rss+xml"`), Equals, true)
+	c.Check(strings.Contains(rw.Body.String(), `type="application/feed+json"`), Equals, true)
+}
+
+func (s *ServingTest) TestCommentsFeed(c *C) {
+	p, comments := testPost()
+	p.NumComments = 0
+	storePost(s.ctx, p)
+	for i := range comments {
+		c.Assert(storeComment(s.ctx, p, &comments[i]), IsNil)
+	}
+	storePost(s.ctx, &Post{Title: "Quiet"})
+	user.GetTestable(s.ctx).Logout()
+
+	get := func(path string, vars map[string]string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		r := &http.Request{Method: "GET", URL: &url.URL{Path: path}, Host: "example.com"}
+		commentsFeed(s.ctx, rw, mux.SetURLVars(r, vars))
+		return rw
+	}
+
+	rw := get("/blog/comments/feed", nil)
+	c.Assert(rw.Code, Equals, http.StatusOK)
+	c.Check(rw.Header().Get("Content-Type"), Equals, "application/atom+xml; charset=utf-8")
+	all := validateAtom(c, rw.Body.String())
+	c.Assert(all.Entries, HasLen, 2)
+	c.Check(all.Entries[0].Title, DeepEquals, []string{"Comment by testAuthor2 on Hello World"})
+	c.Check(all.Entries[0].Links[0].Href, Equals, fmt.Sprintf("http://example.com%s#comment-%d",
+		p.Url(), comments[1].Key.IntID()))
+
+	vars := map[string]string{"ymd": p.Created.Format("2006/01/02"), "slug": p.Slug.StringID()}
+	rw = get(string(p.CommentsFeedUrl()), vars)
+	c.Assert(rw.Code, Equals, http.StatusOK)
+	single := validateAtom(c, rw.Body.String())
+	c.Check(single.Entries, HasLen, 2)
+	c.Check(single.ID, Not(DeepEquals), all.ID)
+	c.Check(strings.Contains(rw.Body.String(), `<link rel="self" href="http://example.com`+string(p.CommentsFeedUrl())+`"/>`), Equals, true)
+
+	vars["slug"] = "quiet"
+	rw = get("/blog/comments/feed", vars)
+	c.Assert(rw.Code, Equals, http.StatusOK)
+	c.Check(validateAtom(c, rw.Body.String()).Entries, HasLen, 0)
+	c.Check(func() { get("/blog/comments/feed", map[string]string{"slug": "missing"}) },
+		Panics, datastore.ErrNoSuchEntity)
+}
+
+const atomPubTestEntry = `<?xml version="1.0"?>
+<entry xmlns="http://www.w3.org/2005/Atom" xmlns:app="http://www.w3.org/2007/app">
+  <title>From my editor</title>
+  <content type="text">Written *elsewhere*.</content>
+  <summary>Elsewhere.</summary>
+  <category term="Tools"/>
+  <category term="go"/>
+  <app:control><app:draft>yes</app:draft></app:control>
+</entry>`
+
+func (s *ServingTest) TestAtomPub_XHTMLContent(c *C) {
+	for _, t := range []struct{ entry, text string }{
+		{`<content type="xhtml"><div xmlns="http://www.w3.org/1999/xhtml"><p>Hello <b>you</b></p></div></content>`,
+			"<p>Hello <b>you</b></p>"},
+		{`<content type="xhtml">
+		   <xhtml:div xmlns:xhtml="http://www.w3.org/1999/xhtml">Hi<xhtml:br/></xhtml:div>
+		 </content>`,
+			"Hi<xhtml:br/>"},
+		{`<content type="xhtml"><p>No wrapper</p></content>`, "<p>No wrapper</p>"},
+		{`<content type="text">&lt;p&gt;Escaped&lt;/p&gt;</content>`, "<p>Escaped</p>"},
+	} {
+		var entry atomPubEntry
+		c.Assert(xml.Unmarshal([]byte(`<entry xmlns="http://www.w3.org/2005/Atom">`+t.entry+`</entry>`), &entry), IsNil)
+		c.Check(entry.Content.text(), Equals, t.text, Commentf(t.entry))
+	}
+}
+
+func (s *ServingTest) TestAtomPub(c *C) {
+	do := func(handler appEngineHandlerFunc, method, path string, header http.Header, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		if header == nil {
+			header = http.Header{}
+		}
+		r := &http.Request{Method: method, URL: &url.URL{Path: path}, Host: "example.com",
+			Header: header, Body: ioutil.NopCloser(strings.NewReader(body))}
+		vars := map[string]string{}
+		if slug := strings.TrimPrefix(path, "/blog/atompub/posts/"); slug != path {
+			vars["slug"] = slug
+		}
+		handler(s.ctx, rw, mux.SetURLVars(r, vars))
+		return rw
+	}
+	entryType := http.Header{"Content-Type": {"application/atom+xml;type=entry"}}
+
+	rw := do(atomPubServiceDocument, "GET", "/blog/atompub", nil, "")
+	c.Assert(rw.Code, Equals, http.StatusOK)
+	c.Check(rw.Header().Get("Content-Type"), Equals, "application/atomsvc+xml;charset=utf-8")
+	var service atomPubService
+	c.Assert(xml.Unmarshal(rw.Body.Bytes(), &service), IsNil)
+	c.Check(service.Workspace.Collection.Href, Equals, "http://example.com/blog/atompub/posts")
+
+	c.Check(do(atomPubCollection, "POST", "/blog/atompub/posts", http.Header{"Content-Type": {"image/png"}}, "").Code,
+		Equals, http.StatusUnsupportedMediaType)
+	c.Check(do(atomPubCollection, "POST", "/blog/atompub/posts", entryType, "<entry").Code, Equals, http.StatusBadRequest)
+
+	header := http.Header{"Content-Type": entryType["Content-Type"], "Slug": {"My%20Editor"}}
+	rw = do(atomPubCollection, "POST", "/blog/atompub/posts", header, atomPubTestEntry)
+	c.Assert(rw.Code, Equals, http.StatusCreated)
+	c.Check(rw.Header().Get("Location"), Equals, "http://example.com/blog/atompub/posts/my-editor")
+	var created atomPubEntry
+	c.Assert(xml.Unmarshal(rw.Body.Bytes(), &created), IsNil)
+	c.Check(created.Control, NotNil)
+	p, _ := loadPost(s.ctx, "my-editor")
+	c.Check(p.Title, Equals, "From my editor")
+	c.Check(p.Text, Equals, "Written *elsewhere*.")
+	c.Check(p.Excerpt, Equals, "Elsewhere.")
+	c.Check(p.Tags, DeepEquals, []string{"tools", "go"})
+	c.Check(p.Draft, Equals, true)
+
+	rw = do(atomPubCollection, "GET", "/blog/atompub/posts", nil, "")
+	c.Assert(rw.Code, Equals, http.StatusOK)
+	c.Check(strings.Contains(rw.Body.String(), "From my editor"), Equals, true)
+
+	member := "/blog/atompub/posts/my-editor"
+	rw = do(atomPubMember, "GET", member, nil, "")
+	c.Assert(rw.Code, Equals, http.StatusOK)
+	etag := rw.Header().Get("ETag")
+	c.Check(do(atomPubMember, "GET", member, http.Header{"If-None-Match": {etag}}, "").Code, Equals, http.StatusNotModified)
+
+	// Publish.
+	published := strings.Replace(atomPubTestEntry, "<app:draft>yes</app:draft>", "<app:draft>no</app:draft>", 1)
+	header = http.Header{"Content-Type": entryType["Content-Type"], "If-Match": {etag}}
+	rw = do(atomPubMember, "PUT", member, header, published)
+	c.Assert(rw.Code, Equals, http.StatusOK)
+	p, _ = loadPost(s.ctx, "my-editor")
+	c.Check(p.Draft, Equals, false)
+
+	// The entry changed since etag was read.
+	c.Check(do(atomPubMember, "PUT", member, header, published).Code, Equals, http.StatusPreconditionFailed)
+
+	c.Check(do(atomPubMember, "DELETE", member, nil, "").Code, Equals, http.StatusOK)
+	p, _ = loadPost(s.ctx, "my-editor")
+	c.Check(p.Trashed, Equals, true)
+	c.Check(func() { do(atomPubMember, "GET", member, nil, "") }, Panics, datastore.ErrNoSuchEntity)
+
+	user.GetTestable(s.ctx).Logout()
+	c.Check(do(atomPubServiceDocument, "GET", "/blog/atompub", nil, "").Code, Equals, http.StatusUnauthorized)
+	c.Check(do(atomPubCollection, "POST", "/blog/atompub/posts", entryType, atomPubTestEntry).Code, Equals, http.StatusUnauthorized)
+}
+
+func xmlrpcRequest(method string, params ...string) string {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "<?xml version=\"1.0\"?><methodCall><methodName>%s</methodName><params>", method)
+	for _, param := range params {
+		fmt.Fprintf(&body, "<param><value>%s</value></param>", param)
+	}
+	body.WriteString("</params></methodCall>")
+	return body.String()
+}
+
+func (s *ServingTest) TestXMLRPC(c *C) {
+	password := newAppPassword(s.ctx, loadConfig(s.ctx))
+	user.GetTestable(s.ctx).Logout()
+
+	call := func(body string) (interface{}, *xmlrpcFault) {
+		rw := httptest.NewRecorder()
+		r := &http.Request{Method: "POST", URL: &url.URL{Path: "/xmlrpc"}, Host: "example.com",
+			Body: ioutil.NopCloser(strings.NewReader(body))}
+		xmlrpcHandler(s.ctx, rw, r)
+		c.Assert(rw.Code, Equals, http.StatusOK)
+		var response struct {
+			Param *xmlrpcValue `xml:"params>param>value"`
+			Fault *xmlrpcValue `xml:"fault>value"`
+		}
+		c.Assert(xml.Unmarshal(rw.Body.Bytes(), &response), IsNil)
+		if response.Fault != nil {
+			fault, err := response.Fault.decode()
+			c.Assert(err, IsNil)
+			members := fault.(map[string]interface{})
+			return nil, &xmlrpcFault{members["faultCode"].(int), members["faultString"].(string)}
+		}
+		result, err := response.Param.decode()
+		c.Assert(err, IsNil)
+		return result, nil
+	}
+	auth := []string{"<string>1</string>", "<string>editor</string>", "<string>" + password + "</string>"}
+
+	_, fault := call(xmlrpcRequest("metaWeblog.getRecentPosts", "1", "editor", "wrong", "<int>10</int>"))
+	c.Assert(fault, NotNil)
+	c.Check(fault.Code, Equals, faultUnauthorized)
+	_, fault = call(xmlrpcRequest("metaWeblog.frobnicate"))
+	c.Check(fault.Code, Equals, faultUnknownMethod)
+	_, fault = call("<methodCall")
+	c.Check(fault.Code, Equals, faultParse)
+
+	post := `<struct>
+		<member><name>title</name><value>Offline &amp; online</value></member>
+		<member><name>description</name><value><string>Some *markdown*.</string></value></member>
+		<member><name>categories</name><value><array><data>
+			<value>Editors</value><value>go</value>
+		</data></array></value></member>
+		<member><name>wp_slug</name><value>offline</value></member>
+	</struct>`
+	result, fault := call(xmlrpcRequest("metaWeblog.newPost", append(auth, post, "<boolean>0</boolean>")...))
+	c.Assert(fault, IsNil)
+	c.Check(result, Equals, "offline")
+	p, _ := loadPost(withAppPassword(s.ctx), "offline")
+	c.Check(p.Title, Equals, "Offline & online")
+	c.Check(p.Text, Equals, "Some *markdown*.")
+	c.Check(p.Tags, DeepEquals, []string{"editors", "go"})
+	c.Check(p.Draft, Equals, true)
+
+	// Drafts are listed for API clients.
+	result, fault = call(xmlrpcRequest("metaWeblog.getRecentPosts", append(auth, "<int>10</int>")...))
+	c.Assert(fault, IsNil)
+	c.Assert(result, HasLen, 1)
+	recent := result.([]interface{})[0].(map[string]interface{})
+	c.Check(recent["postid"], Equals, "offline")
+	c.Check(recent["post_status"], Equals, "draft")
+	c.Check(recent["link"], Matches, `http://example\.com/blog/\d{4}/\d{2}/\d{2}/offline/`)
+	for _, count := range []string{"0", "-1"} {
+		_, fault = call(xmlrpcRequest("metaWeblog.getRecentPosts", append(auth, "<int>"+count+"</int>")...))
+		c.Assert(fault, NotNil, Commentf(count))
+		c.Check(fault.Code, Equals, faultInvalidParams)
+	}
+	for i := 0; i < maxRecentPosts; i++ {
+		storePost(s.ctx, &Post{Title: fmt.Sprintf("Filler %d", i)})
+	}
+	result, fault = call(xmlrpcRequest("metaWeblog.getRecentPosts", append(auth, "<int>2147483647</int>")...))
+	c.Assert(fault, IsNil)
+	c.Check(result, HasLen, maxRecentPosts)
+
+	edit := `<struct><member><name>description</name><value>Edited.</value></member></struct>`
+	postAuth := append([]string{"offline"}, auth[1:]...)
+	result, fault = call(xmlrpcRequest("metaWeblog.editPost", append(postAuth, edit, "<boolean>1</boolean>")...))
+	c.Assert(fault, IsNil)
+	c.Check(result, Equals, true)
+	result, fault = call(xmlrpcRequest("metaWeblog.getPost", postAuth...))
+	c.Assert(fault, IsNil)
+	fetched := result.(map[string]interface{})
+	c.Check(fetched["title"], Equals, "Offline & online")
+	c.Check(fetched["description"], Equals, "Edited.")
+	c.Check(fetched["post_status"], Equals, "publish")
+
+	media := `<struct>
+		<member><name>name</name><value>My Photo.PNG</value></member>
+		<member><name>type</name><value>image/png</value></member>
+		<member><name>bits</name><value><base64>iVBORw0KGgo=</base64></value></member>
+	</struct>`
+	result, fault = call(xmlrpcRequest("metaWeblog.newMediaObject", append(auth, media)...))
+	c.Assert(fault, IsNil)
+	c.Check(result.(map[string]interface{})["url"], Equals, "http://example.com/blog/media/my-photo.png")
+	rw := httptest.NewRecorder()
+	r := &http.Request{Method: "GET", URL: &url.URL{Path: "/blog/media/my-photo.png"}}
+	serveMedia(s.ctx, rw, mux.SetURLVars(r, map[string]string{"name": "my-photo.png"}))
+	c.Check(rw.Code, Equals, http.StatusOK)
+	c.Check(rw.Header().Get("Content-Type"), Equals, "image/png")
+	c.Check(rw.Body.String(), Equals, "\x89PNG\r\n\x1a\n")
+	// Errors other than missing posts are faults, too.
+	method := xmlrpcMethods["metaWeblog.getCategories"]
+	defer delete(xmlrpcMethods, "test.fail")
+	method.call = func(call *xmlrpcCall) interface{} { panic(fmt.Errorf("datastore is down")) }
+	xmlrpcMethods["test.fail"] = method
+	_, fault = call(xmlrpcRequest("test.fail", auth...))
+	c.Assert(fault, NotNil)
+	c.Check(fault.Code, Equals, faultInternal)
+	c.Check(fault.Message, Equals, "An internal error occurred")
+
+	// The same name again gets a new one.
+	result, fault = call(xmlrpcRequest("metaWeblog.newMediaObject", append(auth, media)...))
+	c.Assert(fault, IsNil)
+	c.Check(result.(map[string]interface{})["url"], Equals, "http://example.com/blog/media/my-photo-1.png")
+	c.Check(loadMedia(s.ctx, "my-photo.png").Data, DeepEquals, loadMedia(s.ctx, "my-photo-1.png").Data)
+
+	deleteParams := append([]string{"<string>appkey</string>", "offline"}, auth[1:]...)
+	result, fault = call(xmlrpcRequest("blogger.deletePost", deleteParams...))
+	c.Assert(fault, IsNil)
+	_, fault = call(xmlrpcRequest("metaWeblog.getPost", postAuth...))
+	c.Assert(fault, NotNil)
+	c.Check(fault.Code, Equals, faultNotFound)
+}
+
+func (s *ServingTest) TestAppPassword(c *C) {
+	rw := httptest.NewRecorder()
+	editSettings(s.ctx, rw, withFormToken(s.ctx, &http.Request{Method: "POST", URL: &url.URL{Path: "/blog/admin/settings"},
+		PostForm: url.Values{"action": {"new_app_password"}}}))
+	c.Assert(rw.Code, Equals, http.StatusOK)
+	match := regexp.MustCompile(`<code id="new_app_password">([\w-]+)</code>`).FindStringSubmatch(rw.Body.String())
+	c.Assert(match, HasLen, 2)
+	password := match[1]
+	c.Check(checkAppPassword(loadConfig(s.ctx), password), Equals, true)
+	c.Check(checkAppPassword(loadConfig(s.ctx), password+"x"), Equals, false)
+
+	// AtomPub accepts the app password with basic authentication.
+	user.GetTestable(s.ctx).Logout()
+	get := func(password string) int {
+		rw := httptest.NewRecorder()
+		r := &http.Request{Method: "GET", URL: &url.URL{Path: "/blog/atompub"}, Header: http.Header{}}
+		r.SetBasicAuth("editor", password)
+		atomPubServiceDocument(s.ctx, rw, r)
+		return rw.Code
+	}
+	c.Check(get(password), Equals, http.StatusOK)
+	c.Check(get("wrong"), Equals, http.StatusUnauthorized)
+
+	revokeAppPassword(s.ctx, loadConfig(s.ctx))
+	c.Check(get(password), Equals, http.StatusUnauthorized)
+}
+
+func (s *ServingTest) TestMicropub(c *C) {
+	token := newAppPassword(s.ctx, loadConfig(s.ctx))
+	user.GetTestable(s.ctx).Logout()
+	admin := withAppPassword(s.ctx)
+
+	do := func(method, contentType, query, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		r := &http.Request{Method: method, URL: &url.URL{Path: "/blog/micropub", RawQuery: query},
+			Host: "example.com", Body: ioutil.NopCloser(strings.NewReader(body)),
+			Header: http.Header{"Authorization": {"Bearer " + token}}}
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		micropub(s.ctx, rw, r)
+		return rw
+	}
+	form := "application/x-www-form-urlencoded"
+
+	rw := httptest.NewRecorder()
+	micropub(s.ctx, rw, &http.Request{Method: "GET", URL: &url.URL{Path: "/blog/micropub", RawQuery: "q=config"},
+		Header: http.Header{"Authorization": {"Bearer wrong"}}})
+	c.Check(rw.Code, Equals, http.StatusUnauthorized)
+	rw = do("GET", "", "q=config", "")
+	c.Check(rw.Code, Equals, http.StatusOK)
+	c.Check(strings.Contains(rw.Body.String(), `"syndicate-to":[]`), Equals, true)
+	rw = do("GET", "", "q=config&access_token="+url.QueryEscape(token), "")
+	c.Check(rw.Code, Equals, http.StatusOK)
+
+	// Posts without the Authorization header.
+	postForm := func(body string) int {
+		rw := httptest.NewRecorder()
+		micropub(s.ctx, rw, &http.Request{Method: "POST", URL: &url.URL{Path: "/blog/micropub"}, Host: "example.com",
+			Header: http.Header{"Content-Type": {form}}, Body: ioutil.NopCloser(strings.NewReader(body))})
+		return rw.Code
+	}
+	c.Check(postForm("h=entry&content=Form+token&access_token="+url.QueryEscape(token)), Equals, http.StatusCreated)
+	// Signed in admins still need the token, browsers send their cookies along
+	// with cross-site form posts.
+	user.GetTestable(s.ctx).Login("test@example.com", "", true)
+	c.Check(postForm("h=entry&content=Forged"), Equals, http.StatusUnauthorized)
+	user.GetTestable(s.ctx).Logout()
+	// The size limit applies before the token is looked up in the body.
+	large := strings.Repeat("x", maxMicropubRequestSize)
+	c.Check(postForm("h=entry&content="+large+"&access_token="+url.QueryEscape(token)), Equals, http.StatusUnauthorized)
+	rw = do("POST", form, "", "h=entry&content="+large)
+	c.Check(rw.Code, Equals, http.StatusBadRequest)
+
+	// A note, without a name.
+	rw = do("POST", form, "", "h=entry&content=Just+a+short+note+about+%2Athings%2A.&category[]=notes&category[]=Go")
+	c.Assert(rw.Code, Equals, http.StatusCreated)
+	location := rw.Header().Get("Location")
+	c.Check(location, Matches, `http://example\.com/blog/\d{4}/\d{2}/\d{2}/just-a-short-note-about-things/`)
+	slug := "just-a-short-note-about-things"
+	p, _ := loadPost(admin, slug)
+	c.Check(p.Title, Equals, "Just a short note about things.")
+	c.Check(p.Text, Equals, "Just a short note about *things*.")
+	c.Check(p.Tags, DeepEquals, []string{"notes", "go"})
+	c.Check(p.Draft, Equals, false)
+
+	// An article as a draft, in JSON.
+	rw = do("POST", "application/json", "", `{"type": ["h-entry"], "properties": {
+		"name": ["An article"], "content": [{"html": "<p>Hello</p>"}],
+		"post-status": ["draft"], "mp-slug": ["custom-slug"]}}`)
+	c.Assert(rw.Code, Equals, http.StatusCreated)
+	c.Check(rw.Header().Get("Location"), Matches, `.*/custom-slug/`)
+	p, _ = loadPost(admin, "custom-slug")
+	c.Check(p.Title, Equals, "An article")
+	c.Check(p.Text, Equals, "<p>Hello</p>")
+	c.Check(p.Draft, Equals, true)
+
+	rw = do("POST", "application/json", "", `{"action": "update", "url": "`+location+`",
+		"replace": {"content": ["Replaced."]}, "add": {"category": ["extra"]}, "delete": {"category": ["notes"]}}`)
+	c.Assert(rw.Code, Equals, http.StatusNoContent)
+	p, _ = loadPost(admin, slug)
+	c.Check(p.Text, Equals, "Replaced.")
+	c.Check(p.Title, Equals, "Just a short note about things.")
+	c.Check(p.Tags, DeepEquals, []string{"go", "extra"})
+
+	rw = do("GET", "", "q=source&properties[]=content&url="+url.QueryEscape(location), "")
+	c.Assert(rw.Code, Equals, http.StatusOK)
+	var source struct{ Properties map[string][]string }
+	c.Assert(json.Unmarshal(rw.Body.Bytes(), &source), IsNil)
+	c.Check(source.Properties, DeepEquals, map[string][]string{"content": {"Replaced."}})
+
+	rw = do("POST", form, "", "action=delete&url="+url.QueryEscape(location))
+	c.Check(rw.Code, Equals, http.StatusNoContent)
+	p, _ = loadPost(admin, slug)
+	c.Check(p.Trashed, Equals, true)
+	rw = do("POST", form, "", "action=undelete&url="+url.QueryEscape(location))
+	c.Check(rw.Code, Equals, http.StatusNoContent)
+	p, _ = loadPost(admin, slug)
+	c.Check(p.Trashed, Equals, false)
+
+	rw = do("POST", form, "", "action=delete&url=http://example.com/elsewhere")
+	c.Check(rw.Code, Equals, http.StatusBadRequest)
+	c.Check(strings.Contains(rw.Body.String(), `"error":"invalid_request"`), Equals, true)
+}
+
+// fakeWeb serves pages from memory instead of fetching them.
+type fakeWeb map[string]*http.Response
+
+func (web fakeWeb) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, ok := web[r.URL.String()]
+	if !ok {
+		resp = &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found"}
+	}
+	copy := *resp
+	copy.Request = r
+	if body, ok := resp.Header["X-Body"]; ok {
+		copy.Body = ioutil.NopCloser(strings.NewReader(body[0]))
+	} else {
+		copy.Body = ioutil.NopCloser(strings.NewReader(""))
+	}
+	return &copy, nil
+}
+
+func (web fakeWeb) serve(u, body string) {
+	web[u] = &http.Response{StatusCode: http.StatusOK, Status: "200 OK",
+		Header: http.Header{"X-Body": {body}}}
+}
+
+func (s *ServingTest) TestWebmention(c *C) {
+	p, _ := testPost()
+	p.NumComments = 0
+	storePost(s.ctx, p)
+	target := "http://example.com" + string(p.Url())
+	web := fakeWeb{}
+	ctx := urlfetch.Set(s.ctx, web)
+	defer func(lookup func(string) ([]net.IP, error)) { lookupIP = lookup }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "metadata.internal":
+			return []net.IP{net.ParseIP("169.254.169.254")}, nil
+		case "intranet.example.com":
+			return []net.IP{net.ParseIP("203.0.113.7"), net.ParseIP("10.0.0.7")}, nil
+		case "unknown.example.com":
+			return nil, fmt.Errorf("no such host")
+		}
+		return []net.IP{net.ParseIP("203.0.113.1")}, nil
+	}
+
+	send := func(source, target string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		body := url.Values{"source": {source}, "target": {target}}.Encode()
+		r := &http.Request{Method: "POST", URL: &url.URL{Path: "/blog/webmention"}, Host: "example.com",
+			Header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+			Body:   ioutil.NopCloser(strings.NewReader(body))}
+		webmention(ctx, rw, r)
+		return rw
+	}
+	// Runs the verification tasks that were queued.
+	verify := func() {
+		tasks := taskqueue.GetTestable(ctx).GetScheduledTasks()
+		queued := tasks[""]
+		tasks[""] = nil
+		for _, task := range queued {
+			r := &http.Request{Method: task.Method, URL: &url.URL{Path: task.Path},
+				Header: http.Header{"X-Appengine-Queuename": {"default"}},
+				Body:   ioutil.NopCloser(bytes.NewReader(task.Payload))}
+			for k, v := range task.Header {
+				r.Header[k] = v
+			}
+			rw := httptest.NewRecorder()
+			verifyWebmention(ctx, rw, r)
+			c.Check(rw.Code, Equals, http.StatusOK)
+		}
+	}
+	mentions := func() []Comment {
+		var comments []Comment
+		q := datastore.NewQuery(CommentEntity).Ancestor(p.Slug).Order("created")
+		c.Assert(datastore.GetAll(s.ctx, q, &comments), IsNil)
+		return comments
+	}
+
+	c.Check(send("http://other.org/reply", "http://example.com/blog/nowhere").Code, Equals, http.StatusBadRequest)
+	c.Check(send("http://other.org/reply", "http://elsewhere.com"+string(p.Url())).Code, Equals, http.StatusBadRequest)
+	c.Check(send("ftp://other.org/reply", target).Code, Equals, http.StatusBadRequest)
+	c.Check(send(target, target).Code, Equals, http.StatusBadRequest)
+
+	web.serve("http://other.org/reply", `<html><head><title>Page title</title></head><body>
+		<article class="h-entry">
+		  <a class="p-author h-card" href="/about"><span class="p-name">Jane Doe</span></a>
+		  <a class="u-in-reply-to" href="`+target+`#comments">In reply to</a>
+		  <div class="e-content">I <em>disagree</em>.</div>
+		</article></body></html>`)
+	web.serve("https://likes.net/1", `<div class="h-entry">
+		<div class="p-author h-card"><span class="p-name">Liker</span><a class="u-url" href="https://liker.net/">home</a></div>
+		<a class="u-like-of" href="`+target+`"></a></div>`)
+	web.serve("http://news.com/article", `<html><head><title>Site: News</title></head><body>
+		<h1 class="p-name">Interesting reading</h1><p>See <a href="`+target+`">this</a>.</p></body></html>`)
+	web.serve("http://spam.com/", `<p>No links here.</p>`)
+
+	c.Check(send("http://other.org/reply", target).Code, Equals, http.StatusAccepted)
+	c.Check(send("https://likes.net/1", target).Code, Equals, http.StatusAccepted)
+	c.Check(send("http://news.com/article", target).Code, Equals, http.StatusAccepted)
+	c.Check(send("http://spam.com/", target).Code, Equals, http.StatusAccepted)
+	c.Check(mentions(), HasLen, 0)
+	verify()
+
+	stored := mentions()
+	c.Assert(stored, HasLen, 3)
+	byKind := map[string]Comment{}
+	for _, m := range stored {
+		byKind[m.Kind] = m
+		c.Check(m.Approved, Equals, false)
+	}
+	reply := byKind[commentKindReply]
+	c.Check(reply.Author, Equals, "Jane Doe")
+	c.Check(reply.AuthorUrl, Equals, "http://other.org/about")
+	c.Check(reply.Source, Equals, "http://other.org/reply")
+	c.Check(reply.Text, Equals, "I disagree.")
+	like := byKind[commentKindLike]
+	c.Check(like.Author, Equals, "Liker")
+	c.Check(like.AuthorUrl, Equals, "https://liker.net/")
+	mention := byKind[commentKindMention]
+	c.Check(mention.Author, Equals, "news.com")
+	c.Check(mention.Text, Equals, "Interesting reading")
+
+	for _, m := range stored {
+		c.Assert(moderateComment(s.ctx, m.Key, moderationApprove), IsNil)
+	}
+	user.GetTestable(s.ctx).Logout()
+	rw := httptest.NewRecorder()
+	r := &http.Request{Method: "GET", URL: &url.URL{Path: string(p.Url())}}
+	showPost(s.ctx, rw, mux.SetURLVars(r, map[string]string{
+		"ymd": p.Created.Format("2006/01/02"), "slug": p.Slug.StringID()}))
+	c.Assert(rw.Code, Equals, http.StatusOK)
+	c.Check(rw.Header().Get("Link"), Equals, `</blog/webmention>; rel="webmention"`)
+	body := rw.Body.String()
+	c.Check(strings.Contains(body, `<link rel="webmention" href="/blog/webmention" />`), Equals, true)
+	c.Check(strings.Contains(body, "<p>I disagree.</p>"), Equals, true)
+	c.Check(strings.Contains(body, `<a href="https://liker.net/" rel="nofollow"`), Equals, true)
+	c.Check(strings.Contains(body, `<a href="http://news.com/article" rel="nofollow">Interesting reading</a> by news.com`), Equals, true)
+
+	// Updated sources update their mention, and removed links remove it.
+	web.serve("http://other.org/reply", `<div class="h-entry"><a class="u-in-reply-to" href="`+target+`">Re</a>
+		<p class="p-content">I agree after all.</p></div>`)
+	web["http://news.com/article"] = &http.Response{StatusCode: http.StatusGone, Status: "410 Gone"}
+	web.serve("https://likes.net/1", `<p>Changed my mind.</p>`)
+	send("http://other.org/reply", target)
+	send("http://news.com/article", target)
+	send("https://likes.net/1", target)
+	verify()
+	stored = mentions()
+	c.Assert(stored, HasLen, 1)
+	c.Check(stored[0].Key, DeepEquals, reply.Key)
+	c.Check(stored[0].Text, Equals, "I agree after all.")
+	c.Check(stored[0].Approved, Equals, true)
+	p, _ = loadPost(s.ctx, p.Slug.StringID())
+	c.Check(p.NumComments, Equals, int32(1))
+
+	// Targets match regardless of scheme, host case, default ports and
+	// trailing slashes, and duplicate notifications store a single mention.
+	variant := "HTTPS://Example.COM" + strings.TrimSuffix(string(p.Url()), "/")
+	web.serve("http://blog.org/post", `<p>Also see <a href="`+variant+`">this</a>.</p>`)
+	c.Check(send("http://blog.org/post", "http://EXAMPLE.com:80"+string(p.Url())).Code, Equals, http.StatusAccepted)
+	c.Check(send("http://blog.org/post", target).Code, Equals, http.StatusAccepted)
+	verify()
+	stored = mentions()
+	c.Assert(stored, HasLen, 2)
+	c.Check(stored[1].Source, Equals, "http://blog.org/post")
+	c.Check(send("http://blog.org/"+strings.Repeat("x", maxWebmentionURLLength), target).Code, Equals, http.StatusBadRequest)
+
+	// Sources that are not found any more delete their mentions, too.
+	delete(web, "http://blog.org/post")
+	send("http://blog.org/post", target)
+	verify()
+	stored = mentions()
+	c.Assert(stored, HasLen, 1)
+	c.Check(stored[0].Key, DeepEquals, reply.Key)
+
+	// Sources on internal networks are not fetched, not even by redirects.
+	// Were they, their links would be stored as mentions.
+	links := `<p>See <a href="` + target + `">this</a>.</p>`
+	redirect := func(from, to string) {
+		web[from] = &http.Response{StatusCode: http.StatusFound, Status: "302 Found",
+			Header: http.Header{"Location": {to}}}
+	}
+	for _, source := range []string{"http://127.0.0.1/", "http://[::1]/", "http://10.1.2.3/",
+		"http://169.254.169.254/", "http://metadata.internal/", "http://intranet.example.com/",
+		"http://unknown.example.com/"} {
+		web.serve(source, links)
+		c.Check(send(source, target).Code, Equals, http.StatusAccepted)
+	}
+	redirect("http://redirect.org/", "http://169.254.169.254/")
+	c.Check(send("http://redirect.org/", target).Code, Equals, http.StatusAccepted)
+	for i := 0; i <= maxWebmentionRedirects; i++ {
+		redirect(fmt.Sprintf("http://far.org/%d", i), fmt.Sprintf("http://far.org/%d", i+1))
+	}
+	web.serve(fmt.Sprintf("http://far.org/%d", maxWebmentionRedirects+1), links)
+	c.Check(send("http://far.org/0", target).Code, Equals, http.StatusAccepted)
+	verify()
+	c.Check(mentions(), HasLen, 1)
+
+	// Public redirects are followed.
+	redirect("http://short.org/x", "http://far.org/2")
+	c.Check(send("http://short.org/x", target).Code, Equals, http.StatusAccepted)
+	verify()
+	stored = mentions()
+	c.Assert(stored, HasLen, 2)
+	c.Check(stored[1].Source, Equals, "http://short.org/x")
+}
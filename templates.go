@@ -2,6 +2,9 @@ package blog
 
 import (
 	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
 	"html/template"
 	"io"
 	"log"
@@ -21,18 +24,33 @@ var funcMap = template.FuncMap{
 	"isoDateTime": func(t time.Time) string {
 		return t.Format(time.RFC3339)
 	},
+	"rfc822DateTime": func(t time.Time) string {
+		return t.Format(time.RFC1123Z)
+	},
 	"markdown": func(s string) template.HTML {
 		return markdown(s, 0)
 	},
-	"markdownComment": func(s string) template.HTML {
-		// Essentially just adds rel=nofollow over regular markdown.
-		return markdown(s, blackfriday.HTML_NOFOLLOW_LINKS)
-	},
 	"escapeHtml": func(html template.HTML) template.HTML {
 		return template.HTML(template.HTMLEscapeString(string(html)))
 	},
+	"join": strings.Join,
+	"tagUrl": func(tag string) template.URL {
+		u, err := routeTag.URL("tag", tag)
+		if err != nil {
+			panic(err)
+		}
+		return template.URL(u.String())
+	},
 }
 
+// markdownVersion identifies the configuration of markdown below. Bump it
+// whenever changing the configuration, so that the HTML stored with posts and
+// comments is rendered again.
+const markdownVersion = 1
+
+// Policies are safe to use concurrently once set up.
+var ugcPolicy = bluemonday.UGCPolicy()
+
 func markdown(s string, htmlFlags int) template.HTML {
 	htmlFlags |= blackfriday.HTML_USE_XHTML
 	htmlFlags |= blackfriday.HTML_USE_SMARTYPANTS
@@ -51,13 +69,16 @@ func markdown(s string, htmlFlags int) template.HTML {
 	extensions |= blackfriday.EXTENSION_HEADER_IDS
 
 	unsafe := blackfriday.Markdown([]byte(s), renderer, extensions)
-	safe := bluemonday.UGCPolicy().SanitizeBytes(unsafe)
+	safe := ugcPolicy.SanitizeBytes(unsafe)
 
 	return template.HTML(string(safe))
 }
 
+// baseUri is the path the blog is served under.
+const baseUri = "/blog/"
+
 var templates map[string]*template.Template
-var feedTemplate *template.Template
+var feedTemplate, rssTemplate, commentsFeedTemplate *template.Template
 
 func init() {
 	templates = make(map[string]*template.Template)
@@ -97,18 +118,41 @@ func init() {
 
 	feedTemplate = template.Must(
 		template.New("tmpl/feed.xml").Funcs(funcMap).ParseFiles("tmpl/feed.xml"))
+	rssTemplate = template.Must(
+		template.New("tmpl/rss.xml").Funcs(funcMap).ParseFiles("tmpl/rss.xml"))
+	commentsFeedTemplate = template.Must(
+		template.New("tmpl/comments_feed.xml").Funcs(funcMap).ParseFiles("tmpl/comments_feed.xml"))
 }
 
-func renderPost(wr io.Writer, post *Post, comments []Comment) {
+func renderPost(wr io.Writer, post *Post, comments []Comment, form *CommentForm) {
+	// Likes and mentions are listed separately from comments and replies.
+	var discussion, likes, mentions []Comment
+	for _, comment := range comments {
+		switch comment.Kind {
+		case commentKindLike:
+			likes = append(likes, comment)
+		case commentKindMention:
+			mentions = append(mentions, comment)
+		default:
+			discussion = append(discussion, comment)
+		}
+	}
 	renderTemplate(wr, templates["tmpl/post_single.html"], map[string]interface{}{
-		"Post":     post,
-		"Comments": comments,
+		"Post":         post,
+		"Comments":     discussion,
+		"Likes":        likes,
+		"Mentions":     mentions,
+		"CommentForm":  form,
+		"Canonical":    post.Url(),
+		"CommentsFeed": post.CommentsFeedUrl(),
 	})
 }
 
 type Pagination struct {
 	Previous, Next, Page, PageCount int
 	Pages                           []bool
+	// Path relative to the blog's base URI that page numbers are appended to.
+	Path string
 }
 
 func createPagination(page, pageCount int) Pagination {
@@ -136,24 +180,314 @@ func createPagination(page, pageCount int) Pagination {
 	}
 }
 
-func renderPosts(wr io.Writer, posts []Post, page, pageCount int) {
-	renderTemplate(wr, templates["tmpl/post_page.html"], map[string]interface{}{
+// Navigation links a page of posts to the adjacent newer and older pages.
+type Navigation struct {
+	// Path of the listing relative to the base URI.
+	Path string
+	// Query strings selecting the page itself and the adjacent pages. Self is
+	// empty for the newest page, Newer and Older if there is no such page.
+	Self, Newer, Older template.URL
+	// Oldest selects the page with the oldest posts.
+	Oldest template.URL
+}
+
+func createNavigation(path string, cur pageCursor, newer, older *pageCursor) Navigation {
+	nav := Navigation{
+		Path:   path,
+		Self:   template.URL(cur.queryString()),
+		Oldest: template.URL(oldestPosts.queryString()),
+	}
+	if newer != nil {
+		nav.Newer = template.URL(newer.queryString())
+	}
+	if older != nil {
+		nav.Older = template.URL(older.queryString())
+	}
+	return nav
+}
+
+func postsPageData(posts []Post, sel postSelection, nav Navigation) map[string]interface{} {
+	canonical := baseUri + nav.Path
+	if nav.Self != "" {
+		canonical += "?" + string(nav.Self)
+	}
+	return map[string]interface{}{
+		"Title":      sel.title(),
 		"Posts":      posts,
-		"Pagination": createPagination(page, pageCount),
+		"Navigation": nav,
+		"Canonical":  canonical,
+	}
+}
+
+func renderPosts(wr io.Writer, posts []Post, sel postSelection, nav Navigation) {
+	data := postsPageData(posts, sel, nav)
+	if sel.Tag != "" {
+		data["FeedPath"] = sel.path()
+	}
+	renderTemplate(wr, templates["tmpl/post_page.html"], data)
+}
+
+// Period links to an archive page.
+type Period struct {
+	Path, Name string
+}
+
+func renderArchive(wr io.Writer, posts []Post, sel postSelection, nav Navigation, newer, older *postSelection) {
+	data := postsPageData(posts, sel, nav)
+	if newer != nil {
+		data["NewerPeriod"] = Period{newer.path(), newer.periodName()}
+	}
+	if older != nil {
+		data["OlderPeriod"] = Period{older.path(), older.periodName()}
+	}
+	renderTemplate(wr, templates["tmpl/post_page.html"], data)
+}
+
+func renderArchiveIndex(wr io.Writer, years []ArchiveYear) {
+	renderTemplate(wr, templates["tmpl/archive_index.html"], map[string]interface{}{
+		"Title":     "Archive",
+		"Years":     years,
+		"Canonical": baseUri + "archive/",
 	})
 }
 
-func renderPostsFeed(wr io.Writer, posts []Post, lastUpdated time.Time, page, pageCount int) {
-	renderTemplate(wr, feedTemplate, map[string]interface{}{
-		"Posts":      posts,
+func renderTagIndex(wr io.Writer, tagCounts []TagCount) {
+	renderTemplate(wr, templates["tmpl/tag_index.html"], map[string]interface{}{
+		"Title":     "Tags",
+		"TagCounts": tagCounts,
+		"Canonical": baseUri + "tag/",
+	})
+}
+
+// FeedEntry is a post in a feed, which contains either the post's summary or
+// its full text.
+type FeedEntry struct {
+	Post
+	SummaryOnly bool
+	// ID is the entry's tag URI, Link the absolute URL of the post.
+	ID, Link string
+}
+
+func feedEntries(posts []Post, config *Config, site string) []FeedEntry {
+	entries := make([]FeedEntry, len(posts))
+	for i, p := range posts {
+		entries[i] = FeedEntry{
+			Post:        p,
+			SummaryOnly: config.FeedSummaries && p.Summary() != "",
+			ID:          config.tagURI("post/" + p.Slug.StringID()),
+			Link:        site + string(p.Url()),
+		}
+	}
+	return entries
+}
+
+// renderXMLFeed renders one of the XML feed templates. site is the scheme and
+// host the blog is served from, all links in the feed are absolute.
+func renderXMLFeed(wr io.Writer, t *template.Template, posts []Post, lastUpdated time.Time, sel postSelection, nav Navigation, config *Config, site string) {
+	if _, err := io.WriteString(wr, xml.Header); err != nil {
+		panic(err)
+	}
+	renderTemplate(wr, t, map[string]interface{}{
+		"Title":      sel.title(),
+		"FeedTitle":  config.feedTitle(),
+		"Author":     config.feedAuthor(),
+		"ID":         config.tagURI(nav.Path + "feed"),
+		"Base":       site + baseUri,
+		"Posts":      feedEntries(posts, config, site),
+		"Updated":    lastUpdated,
+		"Navigation": nav,
+	})
+}
+
+// renderPostsFeed renders an Atom feed.
+func renderPostsFeed(wr io.Writer, posts []Post, lastUpdated time.Time, sel postSelection, nav Navigation, config *Config, site string) {
+	renderXMLFeed(wr, feedTemplate, posts, lastUpdated, sel, nav, config, site)
+}
+
+// renderRSSFeed renders an RSS 2.0 feed, which links to adjacent pages like
+// the Atom feed does.
+func renderRSSFeed(wr io.Writer, posts []Post, lastUpdated time.Time, sel postSelection, nav Navigation, config *Config, site string) {
+	renderXMLFeed(wr, rssTemplate, posts, lastUpdated, sel, nav, config, site)
+}
+
+// CommentEntry is a comment in a comments feed.
+type CommentEntry struct {
+	PendingComment
+	// ID is the entry's tag URI, Link the absolute URL of the comment.
+	ID, Link string
+}
+
+// renderCommentsFeed renders an Atom feed of comments on post, or on all posts
+// if post is nil.
+func renderCommentsFeed(wr io.Writer, comments []PendingComment, post *Post, lastUpdated time.Time, nav Navigation, config *Config, site string) {
+	entries := make([]CommentEntry, len(comments))
+	for i, comment := range comments {
+		slug := comment.Post.Slug.StringID()
+		entries[i] = CommentEntry{
+			PendingComment: comment,
+			ID:             config.tagURI(fmt.Sprintf("post/%s/comment/%d", slug, comment.Key.IntID())),
+			Link:           fmt.Sprintf("%s%s#comment-%d", site, comment.Post.Url(), comment.Key.IntID()),
+		}
+	}
+	data := map[string]interface{}{
+		"FeedTitle":  config.feedTitle(),
+		"ID":         config.tagURI("comments/feed"),
+		"Base":       site + baseUri,
+		"Alternate":  site + baseUri,
+		"Comments":   entries,
 		"Updated":    lastUpdated,
-		"Pagination": createPagination(page, pageCount),
+		"Navigation": nav,
+	}
+	if post != nil {
+		data["Post"] = post
+		data["ID"] = config.tagURI("post/" + post.Slug.StringID() + "/comments/feed")
+		data["Alternate"] = site + string(post.Url())
+	}
+	if _, err := io.WriteString(wr, xml.Header); err != nil {
+		panic(err)
+	}
+	renderTemplate(wr, commentsFeedTemplate, data)
+}
+
+// JSONFeed is a JSON Feed, version 1.1, see https://jsonfeed.org/version/1.1.
+type JSONFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	NextURL     string           `json:"next_url,omitempty"`
+	Icon        string           `json:"favicon"`
+	Language    string           `json:"language"`
+	Authors     []JSONFeedAuthor `json:"authors"`
+	Items       []JSONFeedItem   `json:"items"`
+}
+
+type JSONFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type JSONFeedItem struct {
+	ID            string    `json:"id"`
+	URL           string    `json:"url"`
+	Title         string    `json:"title"`
+	ContentHTML   string    `json:"content_html"`
+	DatePublished time.Time `json:"date_published"`
+	DateModified  time.Time `json:"date_modified"`
+	Tags          []string  `json:"tags,omitempty"`
+}
+
+// renderJSONFeed renders a JSON Feed. It has no update time, so lastUpdated
+// is unused.
+func renderJSONFeed(wr io.Writer, posts []Post, lastUpdated time.Time, sel postSelection, nav Navigation, config *Config, site string) {
+	base := site + baseUri + nav.Path
+	feed := JSONFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       config.feedTitle(),
+		HomePageURL: base,
+		FeedURL:     base + "feed.json",
+		Icon:        site + baseUri + "img/favicon.png",
+		Language:    "en",
+		Authors:     []JSONFeedAuthor{{config.feedAuthor()}},
+		Items:       make([]JSONFeedItem, 0, len(posts)),
+	}
+	if title := sel.title(); title != "" {
+		feed.Title += ": " + title
+	}
+	if nav.Self != "" {
+		feed.HomePageURL += "?" + string(nav.Self)
+		feed.FeedURL += "?" + string(nav.Self)
+	}
+	if nav.Older != "" {
+		feed.NextURL = base + "feed.json?" + string(nav.Older)
+	}
+	for _, entry := range feedEntries(posts, config, site) {
+		content := entry.Html()
+		if entry.SummaryOnly {
+			content = entry.SummaryHtml()
+		}
+		feed.Items = append(feed.Items, JSONFeedItem{
+			ID:            entry.ID,
+			URL:           entry.Link,
+			Title:         entry.Title,
+			ContentHTML:   string(content),
+			DatePublished: entry.Created,
+			DateModified:  entry.Updated,
+			Tags:          entry.Tags,
+		})
+	}
+	encoder := json.NewEncoder(wr)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(feed); err != nil {
+		panic(err)
+	}
+}
+
+func renderModerationQueue(wr io.Writer, comments []PendingComment, page, pageCount int, formToken string) {
+	pagination := createPagination(page, pageCount)
+	pagination.Path = "admin/comments/"
+	renderTemplate(wr, templates["tmpl/admin_comments.html"], map[string]interface{}{
+		"Title":      "Comment moderation",
+		"Comments":   comments,
+		"Pagination": pagination,
+		"FormToken":  formToken,
+	})
+}
+
+func renderRevisions(wr io.Writer, post *Post, revisions []Revision, from, to *Revision, formToken string) {
+	data := map[string]interface{}{
+		"Title":     "Revisions of " + post.Title,
+		"Post":      post,
+		"Revisions": revisions,
+		"FormToken": formToken,
+	}
+	if from != nil && to != nil {
+		data["From"] = from
+		data["To"] = to
+		data["Diff"] = diffLines(from.Text, to.Text)
+	}
+	renderTemplate(wr, templates["tmpl/admin_revisions.html"], data)
+}
+
+// renderSettings renders the settings page. newAppPassword is a newly
+// generated app password to show, if any.
+func renderSettings(wr io.Writer, config *Config, newAppPassword, formToken string) {
+	renderTemplate(wr, templates["tmpl/admin_settings.html"], map[string]interface{}{
+		"Title":             "Settings",
+		"Config":            config,
+		"HasAppPassword":    len(config.AppPasswordHash) > 0,
+		"NewAppPassword":    newAppPassword,
+		"DefaultFeedTitle":  defaultFeedTitle,
+		"DefaultFeedAuthor": defaultFeedAuthor,
+		"FormToken":         formToken,
 	})
 }
 
-func renderEditPost(wr io.Writer, post *Post) {
+func renderTrash(wr io.Writer, posts []Post, formToken string) {
+	renderTemplate(wr, templates["tmpl/admin_trash.html"], map[string]interface{}{
+		"Title":     "Trash",
+		"Posts":     posts,
+		"FormToken": formToken,
+	})
+}
+
+// renderEditPost renders the post form. slug is the slug the user asked for,
+// if any, and errors holds errors by form field.
+func renderEditPost(wr io.Writer, post *Post, previews []PreviewLink, slug string, errors map[string]string, formToken string) {
 	renderTemplate(wr, templates["tmpl/post_edit.html"], map[string]interface{}{
-		"Post": post,
+		"Post":      post,
+		"Previews":  previews,
+		"Slug":      slug,
+		"Errors":    errors,
+		"FormToken": formToken,
+	})
+}
+
+func renderPreview(wr io.Writer, post *Post) {
+	renderTemplate(wr, templates["tmpl/post_single.html"], map[string]interface{}{
+		"Title":   "Preview: " + post.Title,
+		"Post":    post,
+		"Preview": true,
+		"NoIndex": true,
 	})
 }
 
@@ -166,7 +500,7 @@ func renderError(wr io.Writer, withDetail bool, msg string, details string) {
 }
 
 func renderTemplate(wr io.Writer, t *template.Template, data map[string]interface{}) {
-	data["baseUri"] = "/blog/"
+	data["baseUri"] = baseUri
 	// Buffer the rendered output so that potential errors don't end up mixed with the output
 	var buffer bytes.Buffer
 	if err := t.ExecuteTemplate(&buffer, "main", data); err != nil {
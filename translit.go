@@ -0,0 +1,75 @@
+package blog
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// transliterationGroups maps groups of lower case letters to the ASCII text
+// they are spelled as in slugs.
+var transliterationGroups = map[string]string{
+	// German
+	"ä": "ae", "ö": "oe", "ü": "ue", "ß": "ss",
+	// Accented latin letters
+	"àáâãåāăą": "a", "çćĉċč": "c", "ďđð": "d", "èéêëēĕėęě": "e",
+	"ĝğġģ": "g", "ĥħ": "h", "ìíîïĩīĭįı": "i", "ĵ": "j", "ķ": "k",
+	"ĺļľŀł": "l", "ñńņňŉ": "n", "òóôõøōŏő": "o", "ŕŗř": "r",
+	"śŝşšșſ": "s", "ţťŧț": "t", "ùúûũūŭůűų": "u", "ŵ": "w",
+	"ýÿŷ": "y", "źżž": "z", "þ": "th",
+	// Ligatures
+	"æ": "ae", "œ": "oe", "ĳ": "ij", "ﬀ": "ff", "ﬁ": "fi", "ﬂ": "fl",
+	"ﬃ": "ffi", "ﬄ": "ffl", "ﬅﬆ": "st",
+	// Greek
+	"αά": "a", "β": "v", "γ": "g", "δ": "d", "εέ": "e", "ζ": "z",
+	"ηή": "i", "θ": "th", "ιίϊΐ": "i", "κ": "k", "λ": "l", "μ": "m",
+	"ν": "n", "ξ": "x", "οό": "o", "π": "p", "ρ": "r", "σς": "s",
+	"τ": "t", "υύϋΰ": "y", "φ": "f", "χ": "ch", "ψ": "ps", "ωώ": "o",
+	// Cyrillic (Russian, Ukrainian)
+	"а": "a", "б": "b", "в": "v", "гґ": "g", "д": "d", "её": "e",
+	"є": "ye", "ж": "zh", "з": "z", "иі": "i", "ї": "yi", "й": "y",
+	"к": "k", "л": "l", "м": "m", "н": "n", "о": "o", "п": "p",
+	"р": "r", "с": "s", "т": "t", "у": "u", "ф": "f", "х": "kh",
+	"ц": "ts", "ч": "ch", "ш": "sh", "щ": "shch", "ъь": "", "ы": "y",
+	"э": "e", "ю": "yu", "я": "ya",
+	// Punctuation that separates words
+	"‐‑‒–—―": "-",
+}
+
+var transliterations = make(map[rune]string)
+
+func init() {
+	for letters, ascii := range transliterationGroups {
+		for _, r := range letters {
+			transliterations[r] = ascii
+		}
+	}
+}
+
+// transliterate lower cases s and replaces letters of common alphabets with
+// their closest ASCII spelling. Accented letters missing from the table are
+// spelled as their base letter. Other characters are kept as they are.
+func transliterate(s string) string {
+	var buffer bytes.Buffer
+	// Compose first, so that decomposed input still matches the table (e.g. a
+	// "u" followed by a combining diaeresis is spelled "ue" like "ü").
+	for _, r := range norm.NFC.String(strings.ToLower(s)) {
+		if ascii, ok := transliterations[r]; ok {
+			buffer.WriteString(ascii)
+			continue
+		}
+		for _, d := range norm.NFD.String(string(r)) {
+			if unicode.Is(unicode.Mn, d) {
+				continue
+			}
+			if ascii, ok := transliterations[d]; ok {
+				buffer.WriteString(ascii)
+			} else {
+				buffer.WriteRune(d)
+			}
+		}
+	}
+	return buffer.String()
+}
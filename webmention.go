@@ -0,0 +1,397 @@
+package blog
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/luci/gae/service/taskqueue"
+	"github.com/luci/gae/service/urlfetch"
+	"github.com/luci/luci-go/common/logging"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+// Webmention (https://www.w3.org/TR/webmention/) lets other sites notify the
+// blog that they link to a post. Notifications are verified asynchronously by
+// fetching the source, and verified mentions are stored as comments that are
+// held for moderation like any other.
+
+const (
+	verifyWebmentionPath = baseUri + "admin/verify_webmention"
+	// Sources larger than this are not read completely.
+	maxWebmentionSourceSize = 1 << 20
+	// Sources are indexed, which limits their length.
+	maxWebmentionURLLength = 1000
+	// Sources are fetched following at most this many redirects.
+	maxWebmentionRedirects = 5
+)
+
+// webmention receives a notification that source links to target, and queues
+// it for verification.
+func webmention(c context.Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	source, target := r.PostForm.Get("source"), r.PostForm.Get("target")
+	if !isWebURL(source) || !isWebURL(target) {
+		http.Error(w, "Bad request: source and target must be http(s) URLs", http.StatusBadRequest)
+		return
+	}
+	if len(source) > maxWebmentionURLLength {
+		http.Error(w, "Bad request: source is too long", http.StatusBadRequest)
+		return
+	}
+	if normalizeURL(source) == normalizeURL(target) {
+		http.Error(w, "Bad request: source and target are the same", http.StatusBadRequest)
+		return
+	}
+	config := loadConfig(c)
+	site, err := url.Parse(siteURL(config, r))
+	if err != nil {
+		panic(err)
+	}
+	if u, _ := url.Parse(target); normalizeHost(u) != normalizeHost(site) {
+		http.Error(w, "Bad request: target is not on this site", http.StatusBadRequest)
+		return
+	}
+	p, err := loadPostByURL(c, target)
+	if err != nil || p.Draft {
+		http.Error(w, "Bad request: target is not a post on this blog", http.StatusBadRequest)
+		return
+	}
+
+	task := taskqueue.NewPOSTTask(verifyWebmentionPath, url.Values{
+		"source": {source},
+		"target": {target},
+	})
+	if err := taskqueue.Add(c, "", task); err != nil {
+		panic(err)
+	}
+	logging.Infof(c, "Queued webmention from %s to %s", source, target)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "Webmention queued for verification")
+}
+
+func isWebURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// verifyWebmention is run from the task queue. It fetches a webmention's
+// source and stores, updates, or deletes the mention depending on whether
+// the source (still) links to the post.
+func verifyWebmention(c context.Context, w http.ResponseWriter, r *http.Request) {
+	// App Engine strips this header from requests that don't come from the
+	// task queue.
+	if r.Header.Get("X-Appengine-Queuename") == "" && !requireAdmin(c, w, r) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		panic(err)
+	}
+	source, target := r.PostForm.Get("source"), r.PostForm.Get("target")
+	p, err := loadPostByURL(c, target)
+	if err == nil && p.Draft {
+		err = fmt.Errorf("%s is not published", target)
+	}
+	if err != nil {
+		// The post was unpublished or removed since.
+		logging.Warningf(c, "Dropping webmention from %s: %s", source, err)
+		return
+	}
+
+	client := &http.Client{
+		Transport: urlfetch.Get(c),
+		Timeout:   30 * time.Second,
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if len(via) > maxWebmentionRedirects {
+				return rejectedSourceError{fmt.Sprintf("more than %d redirects", maxWebmentionRedirects)}
+			}
+			return checkWebmentionSource(r.URL)
+		},
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		panic(err)
+	}
+	if err := checkWebmentionSource(u); err != nil {
+		logging.Warningf(c, "Dropping webmention from %s: %s", source, err)
+		return
+	}
+	resp, err := client.Get(source)
+	if uerr, ok := err.(*url.Error); ok {
+		if _, ok := uerr.Err.(rejectedSourceError); ok {
+			logging.Warningf(c, "Dropping webmention from %s: %s", source, err)
+			return
+		}
+	}
+	if err != nil {
+		// Fails the task, so that it is retried.
+		panic(err)
+	}
+	defer resp.Body.Close()
+
+	var mention *Comment
+	switch {
+	case resp.StatusCode == http.StatusGone || resp.StatusCode == http.StatusNotFound:
+		// Deleted sources delete their mentions, whether they are gone for
+		// good or just not found.
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		base := u
+		if resp.Request != nil {
+			// Relative links resolve against the page after redirects.
+			base = resp.Request.URL
+		}
+		doc, err := html.Parse(io.LimitReader(resp.Body, maxWebmentionSourceSize))
+		if err != nil {
+			logging.Warningf(c, "Cannot parse webmention source %s: %s", source, err)
+			return
+		}
+		mention = parseWebmentionSource(doc, base, target)
+	default:
+		logging.Warningf(c, "Cannot fetch webmention source %s: %s", source, resp.Status)
+		return
+	}
+
+	if mention == nil {
+		existing, err := loadWebmention(c, p, source)
+		if err != nil {
+			panic(err)
+		}
+		if existing != nil {
+			logging.Infof(c, "Deleting webmention from %s, it no longer links to %s", source, target)
+			if err := moderateComment(c, existing.Key, moderationDelete); err != nil {
+				panic(err)
+			}
+		} else {
+			logging.Infof(c, "Ignoring webmention from %s, it does not link to %s", source, target)
+		}
+		return
+	}
+
+	mention.Source = source
+	if err := storeWebmention(c, p, mention); err != nil {
+		panic(err)
+	}
+	logging.Infof(c, "Stored %s from %s on %s", mention.Kind, source, p.Url())
+}
+
+// rejectedSourceError is returned for webmention sources that are not fetched.
+type rejectedSourceError struct {
+	reason string
+}
+
+func (e rejectedSourceError) Error() string {
+	return e.reason
+}
+
+// lookupIP resolves host names, replaced in tests.
+var lookupIP = net.LookupIP
+
+// checkWebmentionSource returns an error if u is not on the public internet.
+// Otherwise anyone could make the blog fetch pages from its internal network
+// or the metadata server. The check resolves the host independently of the
+// fetch, so it does not stop DNS rebinding.
+func checkWebmentionSource(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return rejectedSourceError{fmt.Sprintf("unsupported scheme %q", u.Scheme)}
+	}
+	host := u.Hostname()
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = lookupIP(host); err != nil {
+			return rejectedSourceError{err.Error()}
+		}
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+			ip.IsMulticast() {
+			return rejectedSourceError{fmt.Sprintf("%s resolves to %s, which is not public", host, ip)}
+		}
+	}
+	return nil
+}
+
+// parseWebmentionSource extracts the mention of target from the microformats
+// in a source document. It returns nil if the document doesn't link to target.
+func parseWebmentionSource(doc *html.Node, base *url.URL, target string) *Comment {
+	target = normalizeURL(target)
+	var mention *Comment
+	var author, content, name, title *html.Node
+	var walk func(n *html.Node, inAuthor bool)
+	walk = func(n *html.Node, inAuthor bool) {
+		if n.Type == html.ElementNode {
+			if n.Data == "a" && normalizeURL(resolveURL(base, attr(n, "href"))) == target {
+				kind := commentKindMention
+				if hasClass(n, "u-like-of") {
+					kind = commentKindLike
+				} else if hasClass(n, "u-in-reply-to") {
+					kind = commentKindReply
+				}
+				if mention == nil || mention.Kind == commentKindMention {
+					mention = &Comment{Kind: kind}
+				}
+			}
+			if hasClass(n, "p-author") || hasClass(n, "u-author") {
+				if author == nil {
+					author = n
+				}
+				inAuthor = true
+			}
+			if content == nil && (hasClass(n, "e-content") || hasClass(n, "p-content")) {
+				content = n
+			}
+			// The author's h-card has a name, too.
+			if name == nil && !inAuthor && hasClass(n, "p-name") {
+				name = n
+			}
+			if title == nil && n.Data == "title" {
+				title = n
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child, inAuthor)
+		}
+	}
+	walk(doc, false)
+	if mention == nil {
+		return nil
+	}
+
+	if author != nil {
+		mention.Author = textContent(author)
+		if n := findClass(author, "p-name"); n != nil {
+			mention.Author = textContent(n)
+		}
+		if n := findClass(author, "u-url"); n != nil {
+			mention.AuthorUrl = resolveURL(base, attr(n, "href"))
+		} else if author.Data == "a" {
+			mention.AuthorUrl = resolveURL(base, attr(author, "href"))
+		}
+	}
+	if mention.Author == "" {
+		mention.Author = base.Hostname()
+	}
+	mention.Author = truncateRunes(mention.Author, maxCommentAuthorLength)
+
+	switch mention.Kind {
+	case commentKindReply:
+		if content != nil {
+			mention.Text = textContent(content)
+		}
+	case commentKindMention:
+		if name != nil {
+			mention.Text = textContent(name)
+		} else if title != nil {
+			mention.Text = textContent(title)
+		}
+		if mention.Text == "" {
+			mention.Text = base.String()
+		}
+	}
+	mention.Text = truncateRunes(mention.Text, maxCommentTextLength)
+	return mention
+}
+
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func hasClass(n *html.Node, class string) bool {
+	for _, c := range strings.Fields(attr(n, "class")) {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// findClass returns the first element below n with the given class.
+func findClass(n *html.Node, class string) *html.Node {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.ElementNode && hasClass(child, class) {
+			return child
+		}
+		if found := findClass(child, class); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// textContent returns the text below n, with whitespace collapsed.
+func textContent(n *html.Node) string {
+	var text []string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			text = append(text, n.Data)
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(strings.Join(text, "")), " ")
+}
+
+// resolveURL resolves href relative to base, returning "" for anything but
+// http(s) URLs. Fragments are dropped.
+func resolveURL(base *url.URL, href string) string {
+	u, err := base.Parse(strings.TrimSpace(href))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	u.Fragment = ""
+	return u.String()
+}
+
+// normalizeURL returns the form of an http(s) URL that webmentions compare.
+// Links to a post count no matter the scheme, the case of the host, default
+// ports, a trailing slash, or the fragment. Returns "" for invalid URLs.
+func normalizeURL(s string) string {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	path := strings.TrimSuffix(u.EscapedPath(), "/")
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return "//" + normalizeHost(u) + path
+}
+
+// normalizeHost returns the lower case host of u, without default ports.
+func normalizeHost(u *url.URL) string {
+	host := strings.ToLower(u.Host)
+	if port := u.Port(); port == "80" || port == "443" {
+		host = strings.ToLower(u.Hostname())
+	}
+	return host
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
@@ -0,0 +1,563 @@
+package blog
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/luci/gae/service/datastore"
+	"github.com/luci/luci-go/common/logging"
+	"golang.org/x/net/context"
+)
+
+// The MetaWeblog and Blogger XML-RPC APIs let offline editors manage posts.
+// Clients authenticate with the app password, the user name is ignored.
+// There is a single blog, with the ID "1". Posts are identified by their
+// slug, their text is markdown.
+
+// xmlrpcFault is an error reported to the client.
+type xmlrpcFault struct {
+	Code    int
+	Message string
+}
+
+func (f xmlrpcFault) Error() string {
+	return fmt.Sprintf("XML-RPC fault %d: %s", f.Code, f.Message)
+}
+
+// Fault codes, the standard ones from
+// http://xmlrpc-epi.sourceforge.net/specs/rfc.fault_codes.php.
+const (
+	faultParse          = -32700
+	faultUnknownMethod  = -32601
+	faultInvalidParams  = -32602
+	faultInternal       = -32603
+	faultNotFound       = 404
+	faultUnauthorized   = 403
+	faultInvalidRequest = 400
+)
+
+const maxXMLRPCRequestSize = 2 * maxMediaSize
+
+// xmlrpcValue is a parsed <value>. Values without a type are strings.
+type xmlrpcValue struct {
+	String   *string `xml:"string"`
+	Int      *string `xml:"int"`
+	I4       *string `xml:"i4"`
+	Boolean  *string `xml:"boolean"`
+	Double   *string `xml:"double"`
+	DateTime *string `xml:"dateTime.iso8601"`
+	Base64   *string `xml:"base64"`
+	Struct   *struct {
+		Members []struct {
+			Name  string      `xml:"name"`
+			Value xmlrpcValue `xml:"value"`
+		} `xml:"member"`
+	} `xml:"struct"`
+	Array *struct {
+		Values []xmlrpcValue `xml:"data>value"`
+	} `xml:"array"`
+	Text string `xml:",chardata"`
+}
+
+type xmlrpcMethodCall struct {
+	Method string        `xml:"methodName"`
+	Params []xmlrpcValue `xml:"params>param>value"`
+}
+
+// xmlrpcDateTimeFormats are the formats clients send dates in. The spec has
+// no time zone, which is taken to be UTC.
+var xmlrpcDateTimeFormats = []string{
+	"20060102T15:04:05",
+	"20060102T15:04:05Z",
+	"20060102T15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	time.RFC3339,
+}
+
+// decode converts the value to a string, int, bool, float64, time.Time,
+// []byte, map[string]interface{} or []interface{}.
+func (v *xmlrpcValue) decode() (interface{}, error) {
+	switch {
+	case v.String != nil:
+		return *v.String, nil
+	case v.Int != nil:
+		return strconv.Atoi(strings.TrimSpace(*v.Int))
+	case v.I4 != nil:
+		return strconv.Atoi(strings.TrimSpace(*v.I4))
+	case v.Boolean != nil:
+		return strings.TrimSpace(*v.Boolean) == "1", nil
+	case v.Double != nil:
+		return strconv.ParseFloat(strings.TrimSpace(*v.Double), 64)
+	case v.DateTime != nil:
+		for _, format := range xmlrpcDateTimeFormats {
+			if t, err := time.ParseInLocation(format, strings.TrimSpace(*v.DateTime), time.UTC); err == nil {
+				return t.UTC(), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid date %q", *v.DateTime)
+	case v.Base64 != nil:
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(*v.Base64), ""))
+	case v.Struct != nil:
+		result := make(map[string]interface{})
+		for _, member := range v.Struct.Members {
+			value, err := member.Value.decode()
+			if err != nil {
+				return nil, err
+			}
+			result[member.Name] = value
+		}
+		return result, nil
+	case v.Array != nil:
+		result := make([]interface{}, len(v.Array.Values))
+		for i := range v.Array.Values {
+			value, err := v.Array.Values[i].decode()
+			if err != nil {
+				return nil, err
+			}
+			result[i] = value
+		}
+		return result, nil
+	}
+	return v.Text, nil
+}
+
+func parseXMLRPCCall(r io.Reader) (method string, params []interface{}, err error) {
+	var call xmlrpcMethodCall
+	if err := xml.NewDecoder(r).Decode(&call); err != nil {
+		return "", nil, err
+	}
+	params = make([]interface{}, len(call.Params))
+	for i := range call.Params {
+		if params[i], err = call.Params[i].decode(); err != nil {
+			return "", nil, err
+		}
+	}
+	return call.Method, params, nil
+}
+
+func writeXMLRPCValue(buffer *bytes.Buffer, value interface{}) {
+	buffer.WriteString("<value>")
+	switch v := value.(type) {
+	case string:
+		buffer.WriteString("<string>")
+		xml.EscapeText(buffer, []byte(v))
+		buffer.WriteString("</string>")
+	case int:
+		fmt.Fprintf(buffer, "<int>%d</int>", v)
+	case bool:
+		if v {
+			buffer.WriteString("<boolean>1</boolean>")
+		} else {
+			buffer.WriteString("<boolean>0</boolean>")
+		}
+	case time.Time:
+		fmt.Fprintf(buffer, "<dateTime.iso8601>%s</dateTime.iso8601>", v.UTC().Format("20060102T15:04:05Z"))
+	case []string:
+		buffer.WriteString("<array><data>")
+		for _, s := range v {
+			writeXMLRPCValue(buffer, s)
+		}
+		buffer.WriteString("</data></array>")
+	case []interface{}:
+		buffer.WriteString("<array><data>")
+		for _, element := range v {
+			writeXMLRPCValue(buffer, element)
+		}
+		buffer.WriteString("</data></array>")
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		buffer.WriteString("<struct>")
+		for _, name := range names {
+			buffer.WriteString("<member><name>")
+			xml.EscapeText(buffer, []byte(name))
+			buffer.WriteString("</name>")
+			writeXMLRPCValue(buffer, v[name])
+			buffer.WriteString("</member>")
+		}
+		buffer.WriteString("</struct>")
+	default:
+		panic(fmt.Errorf("cannot encode %T in XML-RPC", value))
+	}
+	buffer.WriteString("</value>")
+}
+
+func writeXMLRPCResponse(w http.ResponseWriter, result interface{}, fault *xmlrpcFault) {
+	var buffer bytes.Buffer
+	buffer.WriteString(xml.Header)
+	buffer.WriteString("<methodResponse>")
+	if fault != nil {
+		buffer.WriteString("<fault>")
+		writeXMLRPCValue(&buffer, map[string]interface{}{
+			"faultCode":   fault.Code,
+			"faultString": fault.Message,
+		})
+		buffer.WriteString("</fault>")
+	} else {
+		buffer.WriteString("<params><param>")
+		writeXMLRPCValue(&buffer, result)
+		buffer.WriteString("</param></params>")
+	}
+	buffer.WriteString("</methodResponse>\n")
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	if _, err := buffer.WriteTo(w); err != nil {
+		panic(err)
+	}
+}
+
+// xmlrpcCall is a call to one of the API methods. Methods panic with an
+// xmlrpcFault to report errors to the client.
+type xmlrpcCall struct {
+	c      context.Context
+	r      *http.Request
+	params []interface{}
+}
+
+func (call *xmlrpcCall) param(i int) interface{} {
+	if i >= len(call.params) {
+		panic(xmlrpcFault{faultInvalidParams, fmt.Sprintf("missing parameter %d", i+1)})
+	}
+	return call.params[i]
+}
+
+func (call *xmlrpcCall) stringParam(i int) string {
+	switch v := call.param(i).(type) {
+	case string:
+		return v
+	case int:
+		// Some clients send IDs as numbers.
+		return strconv.Itoa(v)
+	}
+	panic(xmlrpcFault{faultInvalidParams, fmt.Sprintf("parameter %d must be a string", i+1)})
+}
+
+func (call *xmlrpcCall) intParam(i int) int {
+	if v, ok := call.param(i).(int); ok {
+		return v
+	}
+	panic(xmlrpcFault{faultInvalidParams, fmt.Sprintf("parameter %d must be an int", i+1)})
+}
+
+// boolParam returns the parameter, or true if the client left it out.
+func (call *xmlrpcCall) boolParam(i int) bool {
+	if i >= len(call.params) {
+		return true
+	}
+	if v, ok := call.params[i].(bool); ok {
+		return v
+	}
+	panic(xmlrpcFault{faultInvalidParams, fmt.Sprintf("parameter %d must be a boolean", i+1)})
+}
+
+func (call *xmlrpcCall) structParam(i int) map[string]interface{} {
+	if v, ok := call.param(i).(map[string]interface{}); ok {
+		return v
+	}
+	panic(xmlrpcFault{faultInvalidParams, fmt.Sprintf("parameter %d must be a struct", i+1)})
+}
+
+// authenticate checks the password in the given parameter, and continues the
+// call as an admin.
+func (call *xmlrpcCall) authenticate(i int) {
+	if !checkAppPassword(loadConfig(call.c), call.stringParam(i)) {
+		panic(xmlrpcFault{faultUnauthorized, "Invalid user name or password"})
+	}
+	call.c = withAppPassword(call.c)
+}
+
+func (call *xmlrpcCall) loadPost(i int) *Post {
+	p := loadVisiblePost(call.c, call.stringParam(i))
+	if p.Trashed {
+		panic(datastore.ErrNoSuchEntity)
+	}
+	return p
+}
+
+// xmlrpcMethods maps method names to their implementations, along with the
+// position of the password parameter.
+var xmlrpcMethods = map[string]struct {
+	password int
+	call     func(call *xmlrpcCall) interface{}
+}{
+	"blogger.getUsersBlogs":     {2, xmlrpcGetUsersBlogs},
+	"metaWeblog.getUsersBlogs":  {2, xmlrpcGetUsersBlogs},
+	"metaWeblog.newPost":        {2, xmlrpcNewPost},
+	"metaWeblog.editPost":       {2, xmlrpcEditPost},
+	"metaWeblog.getPost":        {2, xmlrpcGetPost},
+	"metaWeblog.getRecentPosts": {2, xmlrpcGetRecentPosts},
+	"metaWeblog.getCategories":  {2, xmlrpcGetCategories},
+	"metaWeblog.newMediaObject": {2, xmlrpcNewMediaObject},
+	"blogger.deletePost":        {3, xmlrpcDeletePost},
+	"metaWeblog.deletePost":     {3, xmlrpcDeletePost},
+}
+
+func xmlrpcHandler(c context.Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "XML-RPC requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	name, params, err := parseXMLRPCCall(http.MaxBytesReader(w, r.Body, maxXMLRPCRequestSize))
+	if err != nil {
+		writeXMLRPCResponse(w, nil, &xmlrpcFault{faultParse, "Invalid request: " + err.Error()})
+		return
+	}
+	method, ok := xmlrpcMethods[name]
+	if !ok {
+		writeXMLRPCResponse(w, nil, &xmlrpcFault{faultUnknownMethod, "Unknown method " + name})
+		return
+	}
+
+	call := &xmlrpcCall{c: c, r: r, params: params}
+	var result interface{}
+	fault := func() (fault *xmlrpcFault) {
+		defer func() {
+			switch recovered := recover().(type) {
+			case nil:
+			case xmlrpcFault:
+				fault = &recovered
+			default:
+				if recovered == datastore.ErrNoSuchEntity {
+					fault = &xmlrpcFault{faultNotFound, "Not found"}
+					return
+				}
+				// Clients can only make sense of faults, not of error pages.
+				stack := make([]byte, 4*(2<<10))
+				stack = stack[:runtime.Stack(stack, false)]
+				logging.Errorf(c, "Error in %s: %+v\n%s", name, recovered, stack)
+				fault = &xmlrpcFault{faultInternal, "An internal error occurred"}
+			}
+		}()
+		call.authenticate(method.password)
+		result = method.call(call)
+		return nil
+	}()
+	writeXMLRPCResponse(w, result, fault)
+}
+
+func xmlrpcGetUsersBlogs(call *xmlrpcCall) interface{} {
+	config, site := loadFeedConfig(call.c, call.r)
+	return []interface{}{map[string]interface{}{
+		"blogid":   "1",
+		"blogName": config.feedTitle(),
+		"url":      site + baseUri,
+		"xmlrpc":   site + call.r.URL.Path,
+		"isAdmin":  true,
+	}}
+}
+
+// xmlrpcPost converts a post to a MetaWeblog post struct.
+func xmlrpcPost(p *Post, site string) map[string]interface{} {
+	status := "publish"
+	if p.Draft {
+		status = "draft"
+	}
+	link := site + string(p.Url())
+	return map[string]interface{}{
+		"postid":        p.Slug.StringID(),
+		"userid":        "1",
+		"title":         p.Title,
+		"description":   p.Text,
+		"mt_excerpt":    p.Excerpt,
+		"mt_keywords":   strings.Join(p.Tags, ", "),
+		"categories":    p.Tags,
+		"dateCreated":   p.Created,
+		"date_modified": p.Updated,
+		"link":          link,
+		"permaLink":     link,
+		"wp_slug":       p.Slug.StringID(),
+		"post_status":   status,
+	}
+}
+
+// applyXMLRPCPost updates p from the members of a MetaWeblog post struct that
+// the client sent. Posts that are published with a creation date in the future
+// are scheduled.
+func applyXMLRPCPost(p *Post, post map[string]interface{}, publish bool) {
+	str := func(name string) (string, bool) {
+		value, ok := post[name]
+		if !ok {
+			return "", false
+		}
+		s, ok := value.(string)
+		if !ok {
+			panic(xmlrpcFault{faultInvalidParams, name + " must be a string"})
+		}
+		return s, true
+	}
+	if title, ok := str("title"); ok {
+		p.Title = strings.TrimSpace(title)
+	}
+	if p.Title == "" {
+		panic(xmlrpcFault{faultInvalidRequest, "The post has no title"})
+	}
+	if text, ok := str("description"); ok {
+		p.Text = text
+	}
+	if excerpt, ok := str("mt_excerpt"); ok {
+		p.Excerpt = strings.TrimSpace(excerpt)
+	}
+	if categories, ok := post["categories"].([]interface{}); ok {
+		terms := make([]string, 0, len(categories))
+		for _, category := range categories {
+			if term, ok := category.(string); ok {
+				terms = append(terms, term)
+			}
+		}
+		p.Tags = parseTags(strings.Join(terms, ","))
+	} else if keywords, ok := str("mt_keywords"); ok {
+		p.Tags = parseTags(keywords)
+	}
+
+	p.Draft = !publish
+	p.Scheduled = false
+	if created, ok := post["dateCreated"].(time.Time); ok && publish && created.After(time.Now()) {
+		p.Scheduled, p.PublishAt = true, created
+	}
+}
+
+// xmlrpcSlug returns the slug the client asked for, if any.
+func xmlrpcSlug(post map[string]interface{}) string {
+	hint, _ := post["wp_slug"].(string)
+	return slugHint(hint)
+}
+
+// renameXMLRPCPost renames an existing post to the slug the client asked for,
+// unless it is taken.
+func renameXMLRPCPost(c context.Context, p *Post, post map[string]interface{}) {
+	slug := xmlrpcSlug(post)
+	if slug == "" || slug == p.Slug.StringID() {
+		return
+	}
+	ex, err := datastore.Exists(c, createSlug(c, slug))
+	if err != nil {
+		panic(err)
+	}
+	if !ex.Get(0) {
+		renamePost(c, p, slug)
+	}
+}
+
+// metaWeblog.newPost(blogid, username, password, struct, publish) returns the
+// new post's ID.
+func xmlrpcNewPost(call *xmlrpcCall) interface{} {
+	post := call.structParam(3)
+	p := &Post{}
+	applyXMLRPCPost(p, post, call.boolParam(4))
+	p.Created = time.Now().UTC()
+	p.Updated = p.Created
+	storePostWithSlug(call.c, p, xmlrpcSlug(post))
+	return p.Slug.StringID()
+}
+
+// metaWeblog.editPost(postid, username, password, struct, publish)
+func xmlrpcEditPost(call *xmlrpcCall) interface{} {
+	p := call.loadPost(0)
+	post := call.structParam(3)
+	applyXMLRPCPost(p, post, call.boolParam(4))
+	p.Updated = time.Now().UTC()
+	storePost(call.c, p)
+	renameXMLRPCPost(call.c, p, post)
+	return true
+}
+
+// metaWeblog.getPost(postid, username, password)
+func xmlrpcGetPost(call *xmlrpcCall) interface{} {
+	_, site := loadFeedConfig(call.c, call.r)
+	return xmlrpcPost(call.loadPost(0), site)
+}
+
+// maxRecentPosts limits the number of posts getRecentPosts returns.
+const maxRecentPosts = 100
+
+// metaWeblog.getRecentPosts(blogid, username, password, numberOfPosts)
+// includes drafts. At most maxRecentPosts are returned.
+func xmlrpcGetRecentPosts(call *xmlrpcCall) interface{} {
+	count := call.intParam(3)
+	if count <= 0 {
+		panic(xmlrpcFault{faultInvalidParams, "parameter 4 must be a positive number of posts"})
+	}
+	if count > maxRecentPosts {
+		count = maxRecentPosts
+	}
+	_, site := loadFeedConfig(call.c, call.r)
+	result := make([]interface{}, 0, count)
+	cur := pageCursor{}
+	for len(result) < count {
+		posts, _, older := loadPosts(call.c, allPosts, cur)
+		for i := range posts {
+			if len(result) < count {
+				result = append(result, xmlrpcPost(&posts[i], site))
+			}
+		}
+		if older == nil {
+			break
+		}
+		cur = *older
+	}
+	return result
+}
+
+// metaWeblog.getCategories(blogid, username, password) lists the tags.
+func xmlrpcGetCategories(call *xmlrpcCall) interface{} {
+	_, site := loadFeedConfig(call.c, call.r)
+	result := make([]interface{}, 0)
+	for _, tagCount := range loadTagCounts(call.c) {
+		u, err := routeTag.URL("tag", tagCount.Tag)
+		if err != nil {
+			panic(err)
+		}
+		feed, err := routeTagFeed.URL("tag", tagCount.Tag, "page", "")
+		if err != nil {
+			panic(err)
+		}
+		result = append(result, map[string]interface{}{
+			"categoryId":  tagCount.Tag,
+			"title":       tagCount.Tag,
+			"description": tagCount.Tag,
+			"htmlUrl":     site + u.String(),
+			"rssUrl":      site + feed.String(),
+		})
+	}
+	return result
+}
+
+// blogger.deletePost(appkey, postid, username, password, publish) moves the
+// post to the trash.
+func xmlrpcDeletePost(call *xmlrpcCall) interface{} {
+	trashPost(call.c, call.loadPost(1))
+	return true
+}
+
+// metaWeblog.newMediaObject(blogid, username, password, struct) stores the
+// file in the struct's "bits" under its "name" and returns its URL.
+func xmlrpcNewMediaObject(call *xmlrpcCall) interface{} {
+	media := call.structParam(3)
+	name, _ := media["name"].(string)
+	contentType, _ := media["type"].(string)
+	data, ok := media["bits"].([]byte)
+	if name == "" || !ok {
+		panic(xmlrpcFault{faultInvalidParams, "The media object needs a name and bits"})
+	}
+	if len(data) > maxMediaSize {
+		panic(xmlrpcFault{faultInvalidRequest, fmt.Sprintf("%s is larger than %d bytes", name, maxMediaSize)})
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	m := storeMedia(call.c, name, contentType, data)
+	_, site := loadFeedConfig(call.c, call.r)
+	return map[string]interface{}{"url": site + m.Url()}
+}